@@ -0,0 +1,103 @@
+package automata
+
+// EmptyOp is a set of zero-width assertions about the position between two
+// runes of the input.
+type EmptyOp uint8
+
+const (
+	EmptyBeginLine      EmptyOp = 1 << iota // ^ in multiline mode
+	EmptyEndLine                            // $ in multiline mode
+	EmptyBeginText                          // \A, and ^ otherwise
+	EmptyEndText                            // \z, and $ otherwise
+	EmptyWordBoundary                       // \b
+	EmptyNoWordBoundary                     // \B
+
+	// the word boundaries are decided from these two, which no state asks for
+	emptyAfterWord
+	emptyBeforeWord
+)
+
+// lookbehind holds the assertions that the runes before a position decide on
+// their own.
+const lookbehind = EmptyBeginLine | EmptyBeginText
+
+const wordBoundaries = EmptyWordBoundary | EmptyNoWordBoundary
+
+const allEmptyOps = EmptyBeginLine | EmptyEndLine | EmptyBeginText | EmptyEndText | wordBoundaries
+
+// lookbehindRunes has a rune for every distinct lookbehind context.
+var lookbehindRunes = []rune{-1, '\n', 0, 'a'}
+
+func (op EmptyOp) String() string {
+	names := []string{"^", "$", `\A`, `\z`, `\b`, `\B`}
+	str := ""
+	for i, name := range names {
+		if op&(1<<i) != 0 {
+			str += name
+		}
+	}
+	return str
+}
+
+// emptyOpContext returns the assertions that hold between the runes prev and
+// next, either of which is -1 at the edge of the input.
+func emptyOpContext(prev, next rune) EmptyOp {
+	return joinContext(lookbehindContext(prev), lookaheadContext(next))
+}
+
+// joinContext combines the contexts on either side of a position and decides
+// whether it is a word boundary.
+func joinContext(behind, ahead EmptyOp) EmptyOp {
+	context := behind | ahead
+	if (behind&emptyAfterWord != 0) != (ahead&emptyBeforeWord != 0) {
+		return context | EmptyWordBoundary
+	}
+	return context | EmptyNoWordBoundary
+}
+
+func lookbehindContext(prev rune) EmptyOp {
+	switch {
+	case prev == -1:
+		return EmptyBeginText | EmptyBeginLine
+	case prev == '\n':
+		return EmptyBeginLine
+	case isWordChar(prev):
+		return emptyAfterWord
+	}
+	return 0
+}
+
+func lookaheadContext(next rune) EmptyOp {
+	switch {
+	case next == -1:
+		return EmptyEndText | EmptyEndLine
+	case next == '\n':
+		return EmptyEndLine
+	case isWordChar(next):
+		return emptyBeforeWord
+	}
+	return 0
+}
+
+// isWordChar reports whether ch is an ASCII word character, which is what
+// \b and \B look for on either side.
+func isWordChar(ch rune) bool {
+	return '0' <= ch && ch <= '9' || 'A' <= ch && ch <= 'Z' || ch == '_' || 'a' <= ch && ch <= 'z'
+}
+
+// in -ε-> (op) -ε-> out
+//
+// Entering the middle state requires the assertions in op to hold at the
+// current position. Like the slot states of Capture it sits inside plain in
+// and out states, which the shortcut repetitions may connect directly.
+func Assert(op EmptyOp) NFA {
+	instate := State(false)
+	outstate := State(true)
+	check := State(false)
+	check.Assert = op
+
+	instate.addTransition(EpsilonRange, check)
+	check.addTransition(EpsilonRange, outstate)
+
+	return NFA{in: instate, out: outstate}.withProgCache()
+}
@@ -2,9 +2,11 @@ package automata
 
 import (
 	"fmt"
+	"maps"
 	"slices"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 const (
@@ -14,90 +16,81 @@ const (
 
 type state struct {
 	IsAccepted     bool
-	Transitions    map[string][]*state
+	Transitions    map[RuneRange][]*state
 	EpsilonClosure map[*state]bool
 	Number         int
+	// Slot is the submatch slot that records the input position whenever the
+	// state is entered, or -1.
+	Slot int
+	// Assert holds the assertions that must hold at the current position for
+	// the state to be entered.
+	Assert EmptyOp
+	// Entries counts the transitions into the state.
+	Entries int
 }
 
-func (s state) addTransition(symbol string, state *state) {
+func (s state) addTransition(symbol RuneRange, state *state) {
 	s.Transitions[symbol] = append(s.Transitions[symbol], state)
+	state.Entries++
 }
 
-func (s state) getTransition(symbol string) []*state {
+func (s state) getTransition(symbol RuneRange) []*state {
 	return s.Transitions[symbol]
 }
 
-func (s *state) Matches(str string, visited map[*state]bool) bool {
-	if visited[s] {
-		return false
-	}
-	visited[s] = true
-
-	if len(str) == 0 {
-		if s.IsAccepted {
-			return true
-		}
-
-		for _, nextState := range s.getTransition(EPSILON) {
-			if nextState.Matches("", visited) {
-				return true
-			}
-		}
-		return false
-	}
-
-	symbol := string([]rune(str)[0])
-
-	rest := str[1:]
-
-	for _, nextState := range s.getTransition(symbol) {
-		visited = make(map[*state]bool)
-		if nextState.Matches(rest, visited) {
-			return true
-		}
-	}
-
-	for _, nextState := range s.getTransition(EPSILON) {
-		if nextState.Matches(str, visited) {
-			return true
-		}
-	}
-
-	return false
+// symbols lists the transition labels in order, ε first, so that walking the
+// graph numbers its states the same way every time.
+func (s state) symbols() []RuneRange {
+	return slices.SortedFunc(maps.Keys(s.Transitions), compareRanges)
 }
 
 func (s *state) getEpsilonClosure() map[*state]bool {
 	if s.EpsilonClosure == nil {
-		epsilonTrans := s.getTransition(EPSILON)
-		s.EpsilonClosure = make(map[*state]bool)
-		s.EpsilonClosure[s] = true
-		for _, nextState := range epsilonTrans {
-			if !s.EpsilonClosure[nextState] {
-				s.EpsilonClosure[nextState] = true
-				nextClosure := nextState.getEpsilonClosure()
-				for state := range nextClosure {
-					s.EpsilonClosure[state] = true
-				}
+		s.EpsilonClosure = s.epsilonClosure()
+	}
+	return s.EpsilonClosure
+}
+
+// epsilonClosure works the closure out without caching it on the state, so
+// that building a prog leaves the states untouched.
+func (s *state) epsilonClosure() map[*state]bool {
+	// walk the ε-edges directly: reusing the closure of a state on an
+	// ε-cycle would pick up its closure while it is still incomplete
+	closure := map[*state]bool{s: true}
+	stack := []*state{s}
+	for len(stack) > 0 {
+		st := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, nextState := range st.getTransition(EpsilonRange) {
+			if !closure[nextState] {
+				closure[nextState] = true
+				stack = append(stack, nextState)
 			}
 		}
 	}
-	return s.EpsilonClosure
+	return closure
 }
 
 func State(isAccepted bool) *state {
-	s := state{IsAccepted: isAccepted}
-	s.Transitions = make(map[string][]*state)
+	s := state{IsAccepted: isAccepted, Slot: -1}
+	s.Transitions = make(map[RuneRange][]*state)
 	return &s
 }
 
 type NFA struct {
 	in                 *state
 	out                *state
-	transTable         map[int]map[string][]int
+	transTable         map[int]map[RuneRange][]int
 	acceptingStates    map[*state]bool
 	acceptingStateNums map[int]bool
 
-	alphabet map[string]bool
+	alphabet []RuneRange
+	compiled *progCache
+	longest  bool
+	names    []string
+	// bytes makes the NFA read its input a byte at a time instead of
+	// decoding UTF-8.
+	bytes bool
 }
 
 func (nfa *NFA) SetLabel() {
@@ -109,10 +102,9 @@ func (nfa *NFA) SetLabel() {
 		}
 		visited[st] = true
 		st.Number = len(visited)
-		transitions := st.Transitions
 
-		for _, symTransitions := range transitions {
-			for _, nextState := range symTransitions {
+		for _, symbol := range st.symbols() {
+			for _, nextState := range st.getTransition(symbol) {
 				visitState(nextState)
 			}
 		}
@@ -121,12 +113,61 @@ func (nfa *NFA) SetLabel() {
 	visitState(nfa.in)
 }
 
-func (nfa *NFA) GetTransitionTable() map[int]map[string][]int {
+// states lists the states reachable from in, plus out if it is not.
+func (nfa NFA) states() []*state {
+	visited := make(map[*state]bool)
+	states := []*state{}
+	var visitState func(st *state)
+	visitState = func(st *state) {
+		if visited[st] {
+			return
+		}
+		visited[st] = true
+		states = append(states, st)
+		for _, symbol := range st.symbols() {
+			for _, nextState := range st.getTransition(symbol) {
+				visitState(nextState)
+			}
+		}
+	}
+
+	visitState(nfa.in)
+	visitState(nfa.out)
+	return states
+}
+
+// Clone returns a deep copy of the NFA. The exported combinators clone their
+// arguments, so a fragment can be reused in as many machines as needed.
+func (nfa NFA) Clone() NFA {
+	copies := make(map[*state]*state)
+	for _, st := range nfa.states() {
+		copies[st] = State(st.IsAccepted)
+		copies[st].Slot = st.Slot
+		copies[st].Assert = st.Assert
+	}
+	for original, duplicate := range copies {
+		for symbol, symTransitions := range original.Transitions {
+			for _, nextState := range symTransitions {
+				duplicate.addTransition(symbol, copies[nextState])
+			}
+		}
+	}
+	return NFA{in: copies[nfa.in], out: copies[nfa.out], longest: nfa.longest, names: nfa.names, bytes: nfa.bytes}.withProgCache()
+}
+
+// withProgCache gives the NFA a prog cache of its own. The NFAs handed out by
+// Compile and the exported constructors have one; the ones the combinators
+// build in place start without, and build their prog afresh every time.
+func (nfa NFA) withProgCache() NFA {
+	nfa.compiled = new(progCache)
+	return nfa
+}
+
+func (nfa *NFA) GetTransitionTable() map[int]map[RuneRange][]int {
 	if nfa.transTable == nil {
-		nfa.transTable = make(map[int]map[string][]int)
+		nfa.transTable = make(map[int]map[RuneRange][]int)
 		nfa.acceptingStates = make(map[*state]bool)
 		visited := make(map[*state]bool)
-		symbols := make(map[string]bool)
 
 		var visitState func(st *state)
 		visitState = func(st *state) {
@@ -135,17 +176,14 @@ func (nfa *NFA) GetTransitionTable() map[int]map[string][]int {
 			}
 			visited[st] = true
 			st.Number = len(visited)
-			nfa.transTable[st.Number] = make(map[string][]int)
+			nfa.transTable[st.Number] = make(map[RuneRange][]int)
 			if st.IsAccepted {
 				nfa.acceptingStates[st] = true
 			}
 
-			transitions := st.Transitions
-
-			for sym, symTransitions := range transitions {
+			for _, sym := range st.symbols() {
 				var combineState []int
-				symbols[sym] = true
-				for _, nextState := range symTransitions {
+				for _, nextState := range st.getTransition(sym) {
 					visitState(nextState)
 					combineState = append(combineState, nextState.Number)
 				}
@@ -156,32 +194,152 @@ func (nfa *NFA) GetTransitionTable() map[int]map[string][]int {
 		visitState(nfa.in)
 
 		for state := range visited {
-			delete(nfa.transTable[state.Number], EPSILON)
+			delete(nfa.transTable[state.Number], EpsilonRange)
 			for closureState := range state.getEpsilonClosure() {
-				nfa.transTable[state.Number][EPSILON_CLOSURE] = append(nfa.transTable[state.Number][EPSILON_CLOSURE], closureState.Number)
+				nfa.transTable[state.Number][EpsilonClosureRange] = append(nfa.transTable[state.Number][EpsilonClosureRange], closureState.Number)
 			}
+			slices.Sort(nfa.transTable[state.Number][EpsilonClosureRange])
 		}
 	}
 	return nfa.transTable
 }
 
+// Matches simulates the NFA on the set of states it can be in, advancing the
+// whole set over each rune of str and closing it under ε-edges, so it takes
+// O(len(str)·m) steps for m states and never recurses over the input.
+//
+// Like every matcher here it reads each byte of invalid UTF-8 in str as a
+// U+FFFD of width 1, which classes such as . and [^a] match but no literal
+// does.
 func (nfa NFA) Matches(str string) bool {
-	visited := make(map[*state]bool)
-	return nfa.in.Matches(str, visited)
+	p := nfa.getProg()
+	return simulate(p, []int{p.start}, -1, str)
 }
 
-func (nfa *NFA) GetAlphabet() map[string]bool {
+// simulate closes roots under ε-edges, advances the set over str and reports
+// whether it ends in an accepting state. prev is the rune before str, or -1.
+func simulate[T input](p *prog, roots []int, prev rune, str T) bool {
+	current, next := newStateSet(len(p.accept)), newStateSet(len(p.accept))
+	pending := slices.Clone(roots)
+	for i := 0; ; {
+		ch, width := rune(-1), 0
+		if i < len(str) {
+			ch, width = decodeRune(str, i, p.bytes)
+		}
+		context := emptyOpContext(prev, ch)
+		for _, pc := range pending {
+			current.addClosure(p, pc, context, allEmptyOps)
+		}
+		if i == len(str) {
+			break
+		}
+
+		pending = pending[:0]
+		for _, pc := range current.states {
+			for _, edge := range p.edges[pc] {
+				if !edge.symbol.contains(ch) {
+					continue
+				}
+				for _, nextPc := range edge.next {
+					if next.mark[nextPc] != next.gen {
+						next.mark[nextPc] = next.gen
+						pending = append(pending, nextPc)
+					}
+				}
+			}
+		}
+		if len(pending) == 0 {
+			return false
+		}
+		current.clear()
+		next.clear()
+		prev = ch
+		i += width
+	}
+
+	for _, pc := range current.states {
+		if p.accept[pc] {
+			return true
+		}
+	}
+	return false
+}
+
+type stateSet struct {
+	states []int
+	mark   []int
+	gen    int
+}
+
+func newStateSet(size int) *stateSet {
+	return &stateSet{mark: make([]int, size), gen: 1}
+}
+
+func (set *stateSet) clear() {
+	set.states = set.states[:0]
+	set.gen++
+}
+
+// addClosure adds the states reachable from pc over ε-edges into states whose
+// assertions hold in context. Assertions outside known cannot be decided yet:
+// their states are added, but the walk stops there.
+func (set *stateSet) addClosure(p *prog, pc int, context, known EmptyOp) {
+	if set.mark[pc] == set.gen {
+		return
+	}
+	if p.asserts == 0 {
+		// a state already in the set brings its whole closure with it, so
+		// its closure is skipped
+		for _, closurePc := range p.closure[pc] {
+			if set.mark[closurePc] != set.gen {
+				set.mark[closurePc] = set.gen
+				set.states = append(set.states, closurePc)
+			}
+		}
+		return
+	}
+
+	op := p.assert[pc]
+	if op&known&^context != 0 {
+		return
+	}
+	set.mark[pc] = set.gen
+	set.states = append(set.states, pc)
+	if op&^known != 0 {
+		return
+	}
+	for _, next := range p.epsilon[pc] {
+		set.addClosure(p, next, context, known)
+	}
+}
+
+// GetAlphabet partitions the transition labels into sorted, disjoint rune
+// ranges, so every label is a union of alphabet symbols. With assertions the
+// alphabet covers every rune and gives newline and the word characters
+// symbols of their own, since the runes around a position decide them.
+func (nfa *NFA) GetAlphabet() []RuneRange {
 	if nfa.alphabet == nil {
-		nfa.alphabet = make(map[string]bool)
+		labels := []RuneRange{}
+		if nfa.getProg().asserts != 0 {
+			all := AnyRune
+			if nfa.bytes {
+				all = AnyByte
+			}
+			labels = append(labels, all, RuneRange{'\n', '\n'})
+		}
+		if nfa.getProg().asserts&wordBoundaries != 0 {
+			labels = append(labels, perlClasses["w"]...)
+		}
 		table := nfa.GetTransitionTable()
 		for stateNum := range table {
 			transitions := table[stateNum]
 			for symbol := range transitions {
-				if symbol != EPSILON_CLOSURE {
-					nfa.alphabet[symbol] = true
+				if symbol.isSymbol() {
+					labels = append(labels, symbol)
 				}
 			}
 		}
+		nfa.alphabet = partitionRanges(labels)
 	}
 	return nfa.alphabet
 }
@@ -206,25 +364,54 @@ func (nfa NFA) getAcceptingStateNums() map[int]bool {
 type DFA struct {
 	nfa                        *NFA
 	acceptingStateNums         map[string]bool
-	originalTransitonTable     map[string]map[string]string
+	matchedStateNums           map[string]bool
+	originalTransitonTable     map[string]map[RuneRange]string
 	originalAcceptingStateNums map[string]bool
 
 	originalStartState string
 	startState         string
-
-	transTable map[string]map[string]string
+	// startStates holds the states to start searching in, by the lookbehind
+	// context of the position, if the pattern has assertions.
+	startStates map[EmptyOp]string
+	// matchOnly marks a DFA that only knows the strings Matches accepts,
+	// without the start and matched states that searching with assertions
+	// needs.
+	matchOnly bool
+
+	alphabet   []RuneRange
+	transTable map[string]map[RuneRange]string
+	lazy       *lazyDFA
+	bytes      bool
 }
 
-func NewDFA(nfa *NFA) *DFA {
-	dfa := DFA{nfa: nfa}
-	dfa.GetTransitionTable()
+type DFAOption func(*DFA)
+
+func NewDFA(nfa *NFA, opts ...DFAOption) *DFA {
+	dfa := DFA{nfa: nfa, bytes: nfa.bytes}
+	for _, opt := range opts {
+		opt(&dfa)
+	}
+	if dfa.lazy == nil {
+		dfa.GetTransitionTable()
+	}
 	return &dfa
 }
 
-func (dfa *DFA) GetAlphabet() map[string]bool {
-	return dfa.nfa.GetAlphabet()
+// hasAssertions reports whether the DFA came from a pattern with assertions.
+// It must be called once the transition table is built.
+func (dfa *DFA) hasAssertions() bool {
+	return dfa.startStates != nil || dfa.matchOnly
+}
+
+func (dfa *DFA) GetAlphabet() []RuneRange {
+	if dfa.alphabet == nil {
+		dfa.alphabet = dfa.nfa.GetAlphabet()
+	}
+	return dfa.alphabet
 }
 
+// GetAcceptingStateNums returns the states that accept at the end of the
+// input.
 func (dfa *DFA) GetAcceptingStateNums() map[string]bool {
 	if dfa.acceptingStateNums == nil {
 		dfa.GetTransitionTable()
@@ -232,129 +419,253 @@ func (dfa *DFA) GetAcceptingStateNums() map[string]bool {
 	return dfa.acceptingStateNums
 }
 
-func (dfa *DFA) GetTransitionTable() map[string]map[string]string {
-	if dfa.transTable != nil {
-		return dfa.transTable
-	}
+// dfaState is a state of the subset construction: the sorted prog states the
+// automaton can be in, closed under ε-edges as far as the runes read so far
+// decide the assertions on the way. Assertions that depend on the next rune
+// are left to the transition on it, so their states stay unexpanded.
+//
+// With assertions the state also records the lookbehind context it was closed
+// under, and whether a match ended right before the last rune read, which is
+// only known once that rune is.
+type dfaState struct {
+	states  []int
+	context EmptyOp
+	matched bool
+}
 
-	nfaTable := dfa.nfa.GetTransitionTable()
-	dfa.acceptingStateNums = make(map[string]bool)
+func (s dfaState) label() string {
+	label := intlistToString(s.states, ",")
+	if s.context != 0 || s.matched {
+		label += "/" + strconv.Itoa(int(s.context))
+		if s.matched {
+			label += "m"
+		}
+	}
+	return label
+}
 
-	startState := nfaTable[dfa.nfa.in.Number][EPSILON_CLOSURE]
-	dfa.originalStartState = intlistToString(startState, ",")
+func (s dfaState) dead() bool {
+	return len(s.states) == 0 && !s.matched
+}
 
-	worklist := [][]int{startState}
+func (p *prog) dfaStart() dfaState {
+	return p.dfaClose([]int{p.start}, -1, false)
+}
 
-	alphabet := dfa.GetAlphabet()
-	nfaAcceptingStates := dfa.nfa.getAcceptingStateNums()
+// dfaClose closes roots, the states entered right after prev, under the
+// assertions that prev decides.
+func (p *prog) dfaClose(roots []int, prev rune, matched bool) dfaState {
+	s := dfaState{}
+	if p.asserts != 0 {
+		s.context = lookbehindContext(prev)
+		s.matched = matched
+		// only the word boundaries care whether prev was a word character
+		if p.asserts&wordBoundaries == 0 {
+			s.context &^= emptyAfterWord
+		}
+	}
+	set := newStateSet(len(p.accept))
+	for _, pc := range roots {
+		set.addClosure(p, pc, s.context, lookbehind)
+	}
+	s.states = set.states
+	slices.Sort(s.states)
+	return s
+}
 
-	dfaTable := make(map[string]map[string]string)
+// expand finishes closing s once the lookahead context is known.
+func (p *prog) expand(s dfaState, lookahead EmptyOp) *stateSet {
+	set := newStateSet(len(p.accept))
+	for _, pc := range s.states {
+		set.addClosure(p, pc, joinContext(s.context, lookahead), allEmptyOps)
+	}
+	return set
+}
 
-	var updateAcceptingStates func(stateNums []int) = func(stateNums []int) {
-		for nfaAcceptingState := range nfaAcceptingStates {
-			isContain := slices.Contains(stateNums, nfaAcceptingState)
-			if isContain {
-				dfa.acceptingStateNums[intlistToString(stateNums, ",")] = true
-				break
+func (p *prog) dfaNext(s dfaState, ch rune) dfaState {
+	roots := []int{}
+	matched := false
+	for _, pc := range p.expand(s, lookaheadContext(ch)).states {
+		if p.accept[pc] {
+			matched = true
+		}
+		for _, edge := range p.edges[pc] {
+			if edge.symbol.contains(ch) {
+				roots = append(roots, edge.next...)
 			}
 		}
 	}
+	return p.dfaClose(roots, ch, matched)
+}
 
-	for len(worklist) > 0 {
-		stateNums := worklist[0]
-		worklist = worklist[1:]
-		dfaStateLabel := intlistToString(stateNums, ",")
-		dfaTable[dfaStateLabel] = make(map[string]string)
-
-		for symbol := range alphabet {
-			onSymbol := []int{}
-			updateAcceptingStates(stateNums)
-
-			for _, stateNum := range stateNums {
-				nfaStateNumsOnSymbol := nfaTable[stateNum][symbol]
-				if len(nfaStateNumsOnSymbol) <= 0 {
-					continue
-				}
+// dfaAccepts reports whether s accepts at the end of the input.
+func (p *prog) dfaAccepts(s dfaState) bool {
+	for _, pc := range p.expand(s, lookaheadContext(-1)).states {
+		if p.accept[pc] {
+			return true
+		}
+	}
+	return false
+}
 
-				for _, nfaStateNumOnSymbol := range nfaStateNumsOnSymbol {
-					if nfaTable[nfaStateNumOnSymbol] == nil {
-						continue
-					}
-					onSymbol = append(onSymbol, nfaTable[nfaStateNumOnSymbol][EPSILON_CLOSURE]...)
-				}
-			}
+func (dfa *DFA) GetTransitionTable() map[string]map[RuneRange]string {
+	if dfa.transTable != nil {
+		return dfa.transTable
+	}
 
-			dfaStateNumsOnSymbolSet := make(map[int]bool)
-			for _, symbol := range onSymbol {
-				dfaStateNumsOnSymbolSet[symbol] = true
-			}
-			dfaStateNumsOnSymbol := []int{}
-			for symbol := range dfaStateNumsOnSymbolSet {
-				dfaStateNumsOnSymbol = append(dfaStateNumsOnSymbol, symbol)
-			}
+	p := dfa.nfa.getProg()
+	alphabet := dfa.GetAlphabet()
+	dfa.acceptingStateNums = make(map[string]bool)
+	if p.asserts != 0 {
+		dfa.matchedStateNums = make(map[string]bool)
+	}
 
-			if len(dfaStateNumsOnSymbol) > 0 {
-				dfaOnSymbolStr := intlistToString(dfaStateNumsOnSymbol, ",")
+	// state sets are sorted, so every state gets its canonical label
+	start := p.dfaStart()
+	dfa.originalStartState = start.label()
+
+	worklist := []dfaState{start}
+	if p.asserts != 0 {
+		dfa.startStates = make(map[EmptyOp]string)
+		for _, prev := range lookbehindRunes {
+			st := p.dfaClose([]int{p.start}, prev, false)
+			dfa.startStates[lookbehindContext(prev)] = st.label()
+			worklist = append(worklist, st)
+		}
+	}
 
-				dfaTable[dfaStateLabel][symbol] = dfaOnSymbolStr
+	dfaTable := make(map[string]map[RuneRange]string)
+	for ; len(worklist) > 0; worklist = worklist[1:] {
+		st := worklist[0]
+		dfaStateLabel := st.label()
+		if dfaTable[dfaStateLabel] != nil {
+			continue
+		}
+		dfaTable[dfaStateLabel] = make(map[RuneRange]string)
+		if p.dfaAccepts(st) {
+			dfa.acceptingStateNums[dfaStateLabel] = true
+		}
+		if st.matched {
+			dfa.matchedStateNums[dfaStateLabel] = true
+		}
 
-				if dfaTable[dfaOnSymbolStr] == nil {
-					worklist = append([][]int{dfaStateNumsOnSymbol}, worklist...)
-				}
+		// alphabet symbols never straddle a label boundary, so any rune of
+		// a symbol stands for all of them
+		for _, symbol := range alphabet {
+			next := p.dfaNext(st, symbol.Lo)
+			if next.dead() {
+				continue
+			}
+			dfaOnSymbolStr := next.label()
+			dfaTable[dfaStateLabel][symbol] = dfaOnSymbolStr
+			if dfaTable[dfaOnSymbolStr] == nil {
+				worklist = append(worklist, next)
 			}
-
 		}
-
 	}
 	dfa.transTable = dfa.remapStateNumbers(dfaTable)
 	return dfa.transTable
 }
 
-func (dfa *DFA) remapStateNumbers(calculatedDFATable map[string]map[string]string) map[string]map[string]string {
+func (dfa *DFA) remapStateNumbers(calculatedDFATable map[string]map[RuneRange]string) map[string]map[RuneRange]string {
 	newStatesMap := make(map[string]string)
 	dfa.originalTransitonTable = calculatedDFATable
-	transitionTable := make(map[string]map[string]string)
+	transitionTable := make(map[string]map[RuneRange]string)
 
-	n := 1
-	for origianlNumber := range calculatedDFATable {
-		newStatesMap[origianlNumber] = strconv.Itoa(n)
-		if origianlNumber == dfa.originalStartState {
-			dfa.startState = strconv.Itoa(n)
+	// number the states breadth-first from the start state, following the
+	// sorted alphabet, so the start state is always 1 and equal tables get
+	// equal numbers; the other start states join the walk after it
+	alphabet := dfa.GetAlphabet()
+	queue := []string{dfa.originalStartState}
+	for _, prev := range lookbehindRunes {
+		if label, ok := dfa.startStates[lookbehindContext(prev)]; ok {
+			queue = append(queue, label)
+		}
+	}
+	for ; len(queue) > 0; queue = queue[1:] {
+		if _, ok := newStatesMap[queue[0]]; !ok {
+			newStatesMap[queue[0]] = strconv.Itoa(len(newStatesMap) + 1)
+		}
+		originalRow := calculatedDFATable[queue[0]]
+		for _, symbol := range alphabet {
+			next, ok := originalRow[symbol]
+			if !ok {
+				continue
+			}
+			if _, ok := newStatesMap[next]; !ok {
+				newStatesMap[next] = strconv.Itoa(len(newStatesMap) + 1)
+				queue = append(queue, next)
+			}
 		}
-		n++
 	}
 	for origianlNumber := range calculatedDFATable {
 		originalRow := calculatedDFATable[origianlNumber]
-		row := make(map[string]string)
+		row := make(map[RuneRange]string)
 		for symbol := range originalRow {
 			row[symbol] = newStatesMap[originalRow[symbol]]
 		}
 		transitionTable[newStatesMap[origianlNumber]] = row
 	}
 
+	dfa.startState = newStatesMap[dfa.originalStartState]
+	for context, label := range dfa.startStates {
+		dfa.startStates[context] = newStatesMap[label]
+	}
+
 	dfa.originalAcceptingStateNums = dfa.acceptingStateNums
 	dfa.acceptingStateNums = make(map[string]bool)
 
 	for originalNumber := range dfa.originalAcceptingStateNums {
 		dfa.acceptingStateNums[newStatesMap[originalNumber]] = true
 	}
+	if dfa.matchedStateNums != nil {
+		matchedStateNums := dfa.matchedStateNums
+		dfa.matchedStateNums = make(map[string]bool)
+		for originalNumber := range matchedStateNums {
+			dfa.matchedStateNums[newStatesMap[originalNumber]] = true
+		}
+	}
 
 	return transitionTable
 }
 
+// startAt returns the state to start a search in after the rune prev. It
+// reports false when no start state matches the lookbehind context of prev.
+func (dfa *DFA) startAt(prev rune) (string, bool) {
+	if dfa.startStates == nil {
+		return dfa.startState, true
+	}
+	label, ok := dfa.startStates[lookbehindContext(prev)]
+	return label, ok
+}
+
 func (dfa *DFA) Matches(str string) bool {
+	if dfa.lazy != nil {
+		return lazyMatches(dfa.lazy, str)
+	}
+	return dfaMatches(dfa, str)
+}
+
+func dfaMatches[T input](dfa *DFA, str T) bool {
 	state := dfa.startState
 	table := dfa.GetTransitionTable()
+	alphabet := dfa.GetAlphabet()
 
-	for _, symbol := range str {
+	for i := 0; i < len(str); {
+		ch, width := decodeRune(str, i, dfa.bytes)
 		row, ok := table[state]
 		if !ok {
 			return false
 		}
-		state, ok = row[string(symbol)]
+		k, ok := findRange(alphabet, ch)
+		if !ok {
+			return false
+		}
+		state, ok = row[alphabet[k]]
 		if !ok {
 			return false
 		}
+		i += width
 	}
 
 	acceptingStateNums := dfa.GetAcceptingStateNums()
@@ -362,6 +673,40 @@ func (dfa *DFA) Matches(str string) bool {
 	return ok
 }
 
+// String prints the transition table one state per line in numeric order,
+// with the symbols of each row in alphabet order, e.g.
+//
+//	start: 1
+//	accepting: 2
+//	1: a->2 [b-c]->1
+//	2:
+func (dfa *DFA) String() string {
+	table := dfa.GetTransitionTable()
+	alphabet := dfa.GetAlphabet()
+
+	accepting := slices.SortedFunc(maps.Keys(dfa.GetAcceptingStateNums()), compareStateLabels)
+	str := "start: " + dfa.startState + "\n"
+	str += "accepting: " + strings.Join(accepting, ",") + "\n"
+	for _, label := range slices.SortedFunc(maps.Keys(table), compareStateLabels) {
+		str += label + ":"
+		for _, symbol := range alphabet {
+			if next, ok := table[label][symbol]; ok {
+				str += " " + symbol.String() + "->" + next
+			}
+		}
+		str += "\n"
+	}
+	return str
+}
+
+// compareStateLabels orders numeric state labels by value.
+func compareStateLabels(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
 func intlistToString(il []int, sep string) string {
 	stringArray := make([]string, len(il))
 	for i, v := range il {
@@ -370,12 +715,35 @@ func intlistToString(il []int, sep string) string {
 	return strings.Join(stringArray, sep)
 }
 
-// in -s-> out
+// in -s1-> ... -sn-> out
+//
+// Each rune of symbol takes a transition of its own. Char("") and Char(EPSILON)
+// take a single ε-edge.
 func Char(symbol string) NFA {
+	if symbol == EPSILON || symbol == "" {
+		return CharClass([]RuneRange{EpsilonRange})
+	}
+	runes := []rune(symbol)
+	fragment := CharRange(runes[0], runes[0])
+	for _, ch := range runes[1:] {
+		fragment = concatPair(fragment, CharRange(ch, ch))
+	}
+	return fragment.withProgCache()
+}
+
+// in -[lo-hi]-> out
+func CharRange(lo, hi rune) NFA {
+	return CharClass([]RuneRange{{lo, hi}})
+}
+
+// in -r1|r2|...-> out
+func CharClass(ranges []RuneRange) NFA {
 	instate := State(false)
 	outstate := State(true)
-	instate.addTransition(symbol, outstate)
-	return NFA{in: instate, out: outstate}
+	for _, r := range ranges {
+		instate.addTransition(r, outstate)
+	}
+	return NFA{in: instate, out: outstate}.withProgCache()
 }
 
 func Epsilon() NFA {
@@ -383,81 +751,187 @@ func Epsilon() NFA {
 }
 
 func ConcatPair(first NFA, second NFA) NFA {
+	return concatPair(first.Clone(), second.Clone()).withProgCache()
+}
+
+func Concat(first NFA, rest []NFA) NFA {
+	first = first.Clone()
+	for _, fragment := range rest {
+		first = concatPair(first, fragment.Clone())
+	}
+	return first.withProgCache()
+}
+
+func ChoicePair(first NFA, second NFA) NFA {
+	return choicePair(first.Clone(), second.Clone()).withProgCache()
+}
+
+func Choice(first NFA, rest []NFA) NFA {
+	first = first.Clone()
+	for _, fragment := range rest {
+		first = choicePair(first, fragment.Clone())
+	}
+	return first.withProgCache()
+}
+
+// in -ε-> (2i) -ε-> fragment -ε-> (2i+1) -ε-> out
+//
+// The slot states sit inside plain in and out states, so that the shortcut
+// repetitions, which add ε-edges between in and out, never skip the group
+// while still recording it.
+func Capture(fragment NFA, index int) NFA {
+	return capture(fragment.Clone(), index).withProgCache()
+}
+
+func RepExplicit(fragment NFA) NFA {
+	return repExplicit(fragment.Clone()).withProgCache()
+}
+
+func Rep(fragment NFA) NFA {
+	return rep(fragment.Clone()).withProgCache()
+}
+
+func PlusRepExplicit(fragment NFA) NFA {
+	return plusRepExplicit(fragment.Clone()).withProgCache()
+}
+
+func PlusRep(fragment NFA) NFA {
+	return plusRep(fragment.Clone()).withProgCache()
+}
+
+func QuestionExplicit(fragment NFA) NFA {
+	return questionExplicit(fragment.Clone()).withProgCache()
+}
+
+func Question(fragment NFA) NFA {
+	return question(fragment.Clone()).withProgCache()
+}
+
+// The combinators below build on their arguments in place, which saves the
+// interpreter a copy of every fragment it has just made. The fragments must
+// not be used again afterwards.
+
+func concatPair(first NFA, second NFA) NFA {
 	first.out.IsAccepted = false
 	second.out.IsAccepted = true
 
-	first.out.addTransition(EPSILON, second.in)
+	first.out.addTransition(EpsilonRange, second.in)
 
 	return NFA{in: first.in, out: second.out}
 }
 
-func Concat(first NFA, rest []NFA) NFA {
+func concat(first NFA, rest []NFA) NFA {
 	for _, fragment := range rest {
-		first = ConcatPair(first, fragment)
+		first = concatPair(first, fragment)
 	}
 	return first
 }
 
-func ChoicePair(first NFA, second NFA) NFA {
+func choicePair(first NFA, second NFA) NFA {
 	instate := State(false)
 	outstate := State(true)
 
-	instate.addTransition(EPSILON, first.in)
-	instate.addTransition(EPSILON, second.in)
+	instate.addTransition(EpsilonRange, first.in)
+	instate.addTransition(EpsilonRange, second.in)
 
 	first.out.IsAccepted = false
 	second.out.IsAccepted = false
 
-	first.out.addTransition(EPSILON, outstate)
-	second.out.addTransition(EPSILON, outstate)
+	first.out.addTransition(EpsilonRange, outstate)
+	second.out.addTransition(EpsilonRange, outstate)
 
 	return NFA{in: instate, out: outstate}
 }
 
-func Choice(first NFA, rest []NFA) NFA {
-	for _, fragment := range rest {
-		first = ChoicePair(first, fragment)
-	}
-	return first
+func capture(fragment NFA, index int) NFA {
+	instate := State(false)
+	outstate := State(true)
+	open := State(false)
+	open.Slot = 2 * index
+	closing := State(false)
+	closing.Slot = 2*index + 1
+
+	instate.addTransition(EpsilonRange, open)
+	open.addTransition(EpsilonRange, fragment.in)
+	fragment.out.IsAccepted = false
+	fragment.out.addTransition(EpsilonRange, closing)
+	closing.addTransition(EpsilonRange, outstate)
+
+	return NFA{in: instate, out: outstate}
 }
 
-func RepExplicit(fragment NFA) NFA {
+func repExplicit(fragment NFA) NFA {
 	instate := State(false)
 	outstate := State(true)
 
-	instate.addTransition(EPSILON, fragment.in)
-	instate.addTransition(EPSILON, outstate)
+	instate.addTransition(EpsilonRange, fragment.in)
+	instate.addTransition(EpsilonRange, outstate)
 
 	fragment.out.IsAccepted = false
 
-	fragment.out.addTransition(EPSILON, outstate)
-	outstate.addTransition(EPSILON, fragment.in)
+	fragment.out.addTransition(EpsilonRange, outstate)
+	outstate.addTransition(EpsilonRange, fragment.in)
 
 	return NFA{in: instate, out: outstate}
 }
 
-func Rep(fragment NFA) NFA {
-	fragment.in.addTransition(EPSILON, fragment.out)
-	fragment.out.addTransition(EPSILON, fragment.in)
-	return fragment
+// plusRepExplicit is repExplicit without the edge that skips the fragment.
+// Unlike fragment followed by a copy of it under *, it keeps a single copy,
+// so an iteration that matches nothing cannot follow one that did and
+// overwrite its groups.
+func plusRepExplicit(fragment NFA) NFA {
+	instate := State(false)
+	outstate := State(true)
+
+	instate.addTransition(EpsilonRange, fragment.in)
+
+	fragment.out.IsAccepted = false
+
+	fragment.out.addTransition(EpsilonRange, outstate)
+	outstate.addTransition(EpsilonRange, fragment.in)
+
+	return NFA{in: instate, out: outstate}
 }
 
-func PlusRepExplicit(fragment NFA) NFA {
-	fragmentRep := RepExplicit(fragment)
-	return ConcatPair(fragment, fragmentRep)
+func questionExplicit(fragment NFA) NFA {
+	return choicePair(fragment, Epsilon())
 }
 
-func PlusRep(fragment NFA) NFA {
-	fragment.out.addTransition(EPSILON, fragment.in)
+func rep(fragment NFA) NFA {
+	fragment = isolate(fragment)
+	fragment.in.addTransition(EpsilonRange, fragment.out)
+	fragment.out.addTransition(EpsilonRange, fragment.in)
 	return fragment
 }
 
-func QuestionExplicit(fragment NFA) NFA {
-	return ChoicePair(fragment, Epsilon())
+func plusRep(fragment NFA) NFA {
+	fragment.out.addTransition(EpsilonRange, fragment.in)
+	return fragment
 }
 
-func Question(fragment NFA) NFA {
-	fragment.in.addTransition(EPSILON, fragment.out)
+func question(fragment NFA) NFA {
+	fragment = isolate(fragment)
+	fragment.in.addTransition(EpsilonRange, fragment.out)
+	return fragment
+}
+
+// isolate puts fresh states before in, when in can be reentered, and after
+// out, when out can be left, so that an ε-edge from in to out only ever skips
+// the whole fragment. Otherwise a path could take it after reading part of
+// the fragment, or carry on past out into the fragment again, as (?:a*b)?
+// would on "a" and (?:ba*)? on "a".
+func isolate(fragment NFA) NFA {
+	if fragment.in.Entries > 0 {
+		instate := State(false)
+		instate.addTransition(EpsilonRange, fragment.in)
+		fragment.in = instate
+	}
+	if len(fragment.out.Transitions) > 0 {
+		outstate := State(true)
+		fragment.out.IsAccepted = false
+		fragment.out.addTransition(EpsilonRange, outstate)
+		fragment.out = outstate
+	}
 	return fragment
 }
 
@@ -477,10 +951,10 @@ func (s state) String() string {
 
 	for k := range s.Transitions {
 		if i == 0 {
-			str += string(k) + "->"
+			str += k.String() + "->"
 		} else {
 			str += "|\n"
-			str += "-" + string(k) + "->"
+			str += "-" + k.String() + "->"
 		}
 	}
 	return str
@@ -526,29 +1000,47 @@ func (nfa NFA) String() string {
 	return str
 }
 
-func Digit() NFA {
-	digits := "123456789"
-	first := Char("0")
-	for _, d := range digits {
-		first = ChoicePair(first, Char(string(d)))
+var perlClasses = map[string][]RuneRange{
+	"d": {{'0', '9'}},
+	"s": {{'\t', '\n'}, {'\f', '\r'}, {' ', ' '}},
+	"w": {{'0', '9'}, {'A', 'Z'}, {'_', '_'}, {'a', 'z'}},
+}
+
+// unicodePerlClasses are the Perl classes under UnicodeClasses: decimal
+// digits, white space, and letters, marks, digits and connector punctuation
+// for word characters.
+var unicodePerlClasses = map[string][]RuneRange{
+	"d": tableRanges(unicode.Nd),
+	"s": tableRanges(unicode.White_Space),
+	"w": tableRanges(unicode.L, unicode.M, unicode.Nd, unicode.Pc),
+}
+
+// perlClass returns the ranges of \d, \s, \w or of their negations \D, \S
+// and \W. Byte mode keeps to the ASCII classes.
+func perlClass(name string, flags Flags) []RuneRange {
+	classes := perlClasses
+	if flags&UnicodeClasses != 0 && flags&Bytes == 0 {
+		classes = unicodePerlClasses
 	}
-	return first
+	lower := strings.ToLower(name)
+	if lower != name {
+		return negateRanges(classes[lower], universe(flags))
+	}
+	return classes[name]
+}
+
+func isPerlClass(name string) bool {
+	return len(name) == 1 && strings.Contains("dswDSW", name)
+}
+
+func Digit() NFA {
+	return CharClass(perlClasses["d"])
 }
 
 func Word() NFA {
-	words := "123456789abcdefghiklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
-	first := Char("0")
-	for _, d := range words {
-		first = ChoicePair(first, Char(string(d)))
-	}
-	return first
+	return CharClass(perlClasses["w"])
 }
 
 func Space() NFA {
-	spaces := "\t\n\r\f"
-	first := Char(" ")
-	for _, d := range spaces {
-		first = ChoicePair(first, Char(string(d)))
-	}
-	return first
+	return CharClass(perlClasses["s"])
 }
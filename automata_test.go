@@ -1,17 +1,23 @@
 package automata
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"unicode"
 )
 
 func TestAutomata(t *testing.T) {
 	t.Run("state transition for symbol", func(t *testing.T) {
 		s1 := State(false)
 		s2 := State(false)
-		s1.addTransition("a", s2)
+		s1.addTransition(RuneRange{'a', 'a'}, s2)
 
-		transitions := s1.getTransition("a")
+		transitions := s1.getTransition(RuneRange{'a', 'a'})
 
 		if len(transitions) != 1 {
 			t.Errorf("expected length is %d, got %d", 1, len(transitions))
@@ -52,6 +58,36 @@ func TestAutomata(t *testing.T) {
 				t.Errorf("test %v: gotDfa:%v, wanted:%v", test.testStr, gotDfa, test.expectedResult)
 			}
 		}
+		if !Char("a").Matches("a") {
+			t.Errorf("Char(\"a\").Matches(\"a\"): got:false, wanted:true")
+		}
+	})
+
+	t.Run("char strings", func(t *testing.T) {
+		tests := []struct {
+			symbol         string
+			testStr        string
+			expectedResult bool
+		}{
+			{"ab", "ab", true},
+			{"ab", "a", false},
+			{"ab", "abb", false},
+			{"héllo", "héllo", true},
+			{"", "", true},
+			{"", "\xff", false},
+			{"", "\ufffd", false},
+			{EPSILON, "", true},
+		}
+
+		for _, test := range tests {
+			nfa := Char(test.symbol)
+			if got := nfa.Matches(test.testStr); got != test.expectedResult {
+				t.Errorf("Char(%q) test %q: got:%v, wanted:%v", test.symbol, test.testStr, got, test.expectedResult)
+			}
+			if gotDfa := NewDFA(&nfa).Matches(test.testStr); gotDfa != test.expectedResult {
+				t.Errorf("Char(%q) test %q: gotDfa:%v, wanted:%v", test.symbol, test.testStr, gotDfa, test.expectedResult)
+			}
+		}
 	})
 
 	t.Run("epsilon nfa", func(t *testing.T) {
@@ -345,4 +381,1858 @@ func TestAutomata(t *testing.T) {
 		}
 	})
 
+	t.Run("reused fragments", func(t *testing.T) {
+		d := Digit()
+		pair := Concat(d, []NFA{d})
+		plus := PlusRep(d)
+		plusE := PlusRepExplicit(d)
+		year := Concat(pair, []NFA{pair})
+		date := Concat(year, []NFA{Char("-"), pair, Char("-"), pair})
+		optional := ChoicePair(Question(d), Rep(Capture(ConcatPair(d, Word()), 1)))
+		clone := d.Clone()
+		clone.out.addTransition(EpsilonRange, clone.in)
+
+		tests := []struct {
+			name     string
+			nfa      NFA
+			testStr  string
+			expected bool
+		}{
+			{"d", d, "1", true},
+			{"d", d, "12", false},
+			{"d", d, "", false},
+			{"pair", pair, "12", true},
+			{"pair", pair, "1", false},
+			{"pair", pair, "123", false},
+			{"plus", plus, "123", true},
+			{"plusE", plusE, "123", true},
+			{"plusE", plusE, "", false},
+			{"year", year, "2024", true},
+			{"year", year, "202", false},
+			{"date", date, "2024-01-31", true},
+			{"date", date, "2024-1-31", false},
+			{"optional", optional, "", true},
+			{"optional", optional, "1a2_", true},
+			{"optional", optional, "1a2", false},
+			{"clone", clone, "12", true},
+		}
+
+		for _, test := range tests {
+			dfa := NewDFA(&test.nfa)
+			got := test.nfa.Matches(test.testStr)
+			gotDfa := dfa.Matches(test.testStr)
+			if got != test.expected || gotDfa != test.expected {
+				t.Errorf("%s test %q: got:%v, gotDfa:%v, wanted:%v", test.name, test.testStr, got, gotDfa, test.expected)
+			}
+		}
+	})
+}
+
+func TestCompile(t *testing.T) {
+	t.Run("valid patterns", func(t *testing.T) {
+		tests := []struct {
+			pattern        string
+			testStr        string
+			expectedResult bool
+		}{
+			{"", "", true},
+			{"", "a", false},
+			{"a|", "", true},
+			{"()", "", true},
+			{"(a|b)*c", "abac", true},
+			{"(a|b)*c", "abab", false},
+		}
+
+		for _, test := range tests {
+			nfa, err := Compile(test.pattern)
+			if err != nil {
+				t.Fatalf("pattern %q: unexpected error: %v", test.pattern, err)
+			}
+			got := nfa.Matches(test.testStr)
+			if got != test.expectedResult {
+				t.Errorf("pattern %q test %v: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expectedResult)
+			}
+		}
+	})
+
+	t.Run("syntax errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			code    ErrorCode
+			offset  int
+			token   string
+		}{
+			{"(ab", ErrMissingParen, 0, "("},
+			{"a(b(c)", ErrMissingParen, 1, "("},
+			{"*a", ErrMissingRepeatArgument, 0, "*"},
+			{"a|+", ErrMissingRepeatArgument, 2, "+"},
+			{"a**", ErrInvalidRepeatOp, 1, "**"},
+			{"ab)c", ErrUnexpectedParen, 2, ")"},
+			{"ab\\", ErrTrailingBackslash, 2, "\\"},
+		}
+
+		for _, test := range tests {
+			nfa, err := Compile(test.pattern)
+			if nfa != nil {
+				t.Errorf("pattern %q: expected nil nfa", test.pattern)
+			}
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != test.code || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, test.code, test.offset, test.token)
+			}
+		}
+	})
+
+	t.Run("must compile panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected MustCompile to panic")
+			}
+		}()
+		MustCompile("(ab")
+	})
+}
+
+func TestClass(t *testing.T) {
+	t.Run("bracket classes", func(t *testing.T) {
+		tests := []struct {
+			pattern        string
+			testStr        string
+			expectedResult bool
+		}{
+			{"[abc]", "b", true},
+			{"[abc]", "d", false},
+			{"[abc]", "", false},
+			{"[a-z0-9_]+", "snake_case_2", true},
+			{"[a-z0-9_]+", "camelCase", false},
+			{"[^abc]", "d", true},
+			{"[^abc]", "a", false},
+			{"[^abc]", "", false},
+			{"[^abc]", "é", true},
+			{"[^a-z]*", "ABC 123", true},
+			{"[^a-z]*", "ABc", false},
+			{"[\\]\\-]+", "]-]", true},
+			{"[\\]\\-]+", "a", false},
+			{"[]a]", "]", true},
+			{"[^]a]", "]", false},
+			{"[a-]+", "a-a", true},
+			{"[-a]+", "a-a", true},
+			{"[\\d\\s]+", "1 2\t3", true},
+			{"[\\d\\s]+", "1a", false},
+			{"[^\\w]", "_", false},
+			{"[^\\w]", "!", true},
+			{"x[yz]*|[0-9]", "xzyz", true},
+			{"x[yz]*|[0-9]", "7", true},
+			{"x[yz]*|[0-9]", "x7", false},
+		}
+
+		for _, test := range tests {
+			got := Match(test.testStr, test.pattern)
+			if got != test.expectedResult {
+				t.Errorf("pattern %q test %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expectedResult)
+			}
+			gotDfa := MatchDFA(test.testStr, test.pattern)
+			if gotDfa != test.expectedResult {
+				t.Errorf("pattern %q test %q: gotDfa:%v, wanted:%v", test.pattern, test.testStr, gotDfa, test.expectedResult)
+			}
+		}
+	})
+
+	t.Run("class syntax errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			code    ErrorCode
+			offset  int
+			token   string
+		}{
+			{"a[bc", ErrMissingBracket, 1, "["},
+			{"[]", ErrMissingBracket, 0, "["},
+			{"[z-a]", ErrInvalidCharRange, 1, "z-a"},
+			{"[a-\\d]", ErrInvalidCharRange, 1, "a-\\d"},
+			{"[a\\", ErrTrailingBackslash, 2, "\\"},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != test.code || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, test.code, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestRuneRange(t *testing.T) {
+	t.Run("alphabet partition", func(t *testing.T) {
+		nfa := ChoicePair(CharRange('a', 'm'), ConcatPair(CharRange('f', 'z'), Char("x")))
+
+		got := nfa.GetAlphabet()
+		expected := []RuneRange{{'a', 'e'}, {'f', 'm'}, {'n', 'w'}, {'x', 'x'}, {'y', 'z'}}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%v, wanted:%v", got, expected)
+		}
+	})
+
+	t.Run("negated ranges", func(t *testing.T) {
+		got := negateRanges([]RuneRange{{'x', 'z'}, {'a', 'c'}, {'b', 'd'}}, AnyRune)
+		expected := []RuneRange{{0, '`'}, {'e', 'w'}, {'{', 0x10ffff}}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%v, wanted:%v", got, expected)
+		}
+	})
+
+	t.Run("range nfa", func(t *testing.T) {
+		// [a-z]+|[^\n]
+		nfa := ChoicePair(PlusRep(CharRange('a', 'z')), CharClass(negateRanges([]RuneRange{{'\n', '\n'}}, AnyRune)))
+		dfa := NewDFA(&nfa)
+
+		if len(dfa.GetAlphabet()) != 4 {
+			t.Errorf("expected 4 alphabet symbols, got %v", dfa.GetAlphabet())
+		}
+
+		tests := []struct {
+			testStr        string
+			expectedResult bool
+		}{
+			{"", false},
+			{"abc", true},
+			{"é", true},
+			{"世", true},
+			{"\U0010ffff", true},
+			{"\n", false},
+			{"ab世", false},
+		}
+
+		for _, test := range tests {
+			got := nfa.Matches(test.testStr)
+			if got != test.expectedResult {
+				t.Errorf("test %q: got:%v, wanted:%v", test.testStr, got, test.expectedResult)
+			}
+			gotDfa := dfa.Matches(test.testStr)
+			if gotDfa != test.expectedResult {
+				t.Errorf("test %q: gotDfa:%v, wanted:%v", test.testStr, gotDfa, test.expectedResult)
+			}
+		}
+	})
+}
+
+func TestDot(t *testing.T) {
+	tests := []struct {
+		pattern        string
+		flags          Flags
+		testStr        string
+		expectedResult bool
+	}{
+		{".", 0, "a", true},
+		{".", 0, "é", true},
+		{".", 0, "\U0001f600", true},
+		{".", 0, "", false},
+		{".", 0, "ab", false},
+		{".", 0, "\n", false},
+		{".", DotNL, "\n", true},
+		{"a.*b", 0, "a-x-b", true},
+		{"a.*b", 0, "a\nb", false},
+		{"a.*b", DotNL, "a\nb", true},
+		{"a\\.b", 0, "a.b", true},
+		{"a\\.b", 0, "axb", false},
+		{"[.]", 0, ".", true},
+		{"[.]", 0, "x", false},
+	}
+
+	for _, test := range tests {
+		nfa := MustCompile(test.pattern, WithFlags(test.flags))
+		dfa := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)))
+
+		got := nfa.Matches(test.testStr)
+		if got != test.expectedResult {
+			t.Errorf("pattern %q test %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expectedResult)
+		}
+		gotDfa := dfa.Matches(test.testStr)
+		if gotDfa != test.expectedResult {
+			t.Errorf("pattern %q test %q: gotDfa:%v, wanted:%v", test.pattern, test.testStr, gotDfa, test.expectedResult)
+		}
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	t.Run("counted repetition", func(t *testing.T) {
+		tests := []struct {
+			pattern        string
+			testStr        string
+			expectedResult bool
+		}{
+			{"a{3}", "aaa", true},
+			{"a{3}", "aa", false},
+			{"a{3}", "aaaa", false},
+			{"a{0}", "", true},
+			{"a{0}b", "ab", false},
+			{"a{2,}", "a", false},
+			{"a{2,}", "aa", true},
+			{"a{2,}", "aaaaaaa", true},
+			{"a{0,}", "", true},
+			{"a{1,}", "aaa", true},
+			{"a{2,4}", "a", false},
+			{"a{2,4}", "aa", true},
+			{"a{2,4}", "aaa", true},
+			{"a{2,4}", "aaaa", true},
+			{"a{2,4}", "aaaaa", false},
+			{"a{0,2}", "", true},
+			{"a{0,2}", "aaa", false},
+			{"(ab|c){2}", "abc", true},
+			{"(ab|c){2}", "ab", false},
+			{"[0-9]{3}-[0-9]{4}", "555-1234", true},
+			{"[0-9]{3}-[0-9]{4}", "55-1234", false},
+			{"(a*b){2,3}", "bab", true},
+			{"(a*b){2,3}", "aabbabb", false},
+			{"a{,2}", "a{,2}", true},
+			{"a{x}", "a{x}", true},
+			{"a{2", "a{2", true},
+		}
+
+		for _, test := range tests {
+			got := Match(test.testStr, test.pattern)
+			if got != test.expectedResult {
+				t.Errorf("pattern %q test %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expectedResult)
+			}
+			gotDfa := MatchDFA(test.testStr, test.pattern)
+			if gotDfa != test.expectedResult {
+				t.Errorf("pattern %q test %q: gotDfa:%v, wanted:%v", test.pattern, test.testStr, gotDfa, test.expectedResult)
+			}
+		}
+	})
+
+	t.Run("repetition errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			opts    []Option
+			code    ErrorCode
+			offset  int
+			token   string
+		}{
+			{"a{3,2}", nil, ErrInvalidRepeatSize, 1, "{3,2}"},
+			{"{2}a", nil, ErrMissingRepeatArgument, 0, "{2}"},
+			{"a{2}*", nil, ErrInvalidRepeatOp, 1, "{2}*"},
+			{"a*{2}", nil, ErrInvalidRepeatOp, 1, "*{2}"},
+			{"a{99999999999999999999}", nil, ErrInvalidRepeatSize, 1, "{99999999999999999999}"},
+			{"x(abc){5000}", nil, ErrRepeatTooLarge, 6, "{5000}"},
+			{"a{20}", []Option{WithMaxRepeatStates(10)}, ErrRepeatTooLarge, 1, "{20}"},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern, test.opts...)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != test.code || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, test.code, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestFind(t *testing.T) {
+	t.Run("find string", func(t *testing.T) {
+		nfa := MustCompile("[0-9]+")
+		dfa := NewDFA(MustCompile("[0-9]+"))
+
+		if got := nfa.FindString("order 66 shipped"); got != "66" {
+			t.Errorf("got:%q, wanted:%q", got, "66")
+		}
+		if got := dfa.FindString("order 66 shipped"); got != "66" {
+			t.Errorf("gotDfa:%q, wanted:%q", got, "66")
+		}
+		if got := nfa.FindStringIndex("no digits"); got != nil {
+			t.Errorf("got:%v, wanted:nil", got)
+		}
+		if got := dfa.FindIndex([]byte("12 and 345")); !reflect.DeepEqual(got, []int{0, 2}) {
+			t.Errorf("gotDfa:%v, wanted:%v", got, []int{0, 2})
+		}
+		if got := nfa.FindAllString("1, 22, 333", 2); !reflect.DeepEqual(got, []string{"1", "22"}) {
+			t.Errorf("got:%v, wanted:%v", got, []string{"1", "22"})
+		}
+	})
+
+	t.Run("leftmost-first and leftmost-longest", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			first    []int
+			longest  []int
+			allFirst [][]int
+		}{
+			{"ab|abcd", "xabcd", []int{1, 3}, []int{1, 5}, [][]int{{1, 3}}},
+			{"(a|ab)(c|bcd)", "abcd", []int{0, 4}, []int{0, 4}, [][]int{{0, 4}}},
+			{"a*", "baaa", []int{0, 0}, []int{0, 0}, [][]int{{0, 0}, {1, 4}}},
+			{"a+", "baaab", []int{1, 4}, []int{1, 4}, [][]int{{1, 4}}},
+			{"", "ab", []int{0, 0}, []int{0, 0}, [][]int{{0, 0}, {1, 1}, {2, 2}}},
+			{"a?", "aab", []int{0, 1}, []int{0, 1}, [][]int{{0, 1}, {1, 2}, {3, 3}}},
+			{"[^a-z!]+", "caféé!", []int{3, 7}, []int{3, 7}, nil},
+			{"x", "abc", nil, nil, nil},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			if got := nfa.FindStringIndex(test.testStr); !reflect.DeepEqual(got, test.first) {
+				t.Errorf("pattern %q test %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.first)
+			}
+			if test.allFirst != nil {
+				if got := nfa.FindAllStringIndex(test.testStr, -1); !reflect.DeepEqual(got, test.allFirst) {
+					t.Errorf("pattern %q test %q: got all:%v, wanted:%v", test.pattern, test.testStr, got, test.allFirst)
+				}
+			}
+
+			longest := MustCompile(test.pattern)
+			longest.Longest()
+			if got := longest.FindStringIndex(test.testStr); !reflect.DeepEqual(got, test.longest) {
+				t.Errorf("pattern %q test %q: got longest:%v, wanted:%v", test.pattern, test.testStr, got, test.longest)
+			}
+
+			dfa := NewDFA(MustCompile(test.pattern))
+			if got := dfa.FindStringIndex(test.testStr); !reflect.DeepEqual(got, test.longest) {
+				t.Errorf("pattern %q test %q: gotDfa:%v, wanted:%v", test.pattern, test.testStr, got, test.longest)
+			}
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{"a+", "a*", "ab|a", "(a|b)*c", "[0-9]+|[a-z]+", "x*", "a.c", "b{2,3}", "(ab)?b", "(a|ab)(c|bcd)(d*)"}
+		inputs := []string{"", "abc", "aabbbcab", "xxaxcbbbb", "abcd abbb a1c", "123abc45"}
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(pattern)
+			reLongest := regexp.MustCompile(pattern)
+			reLongest.Longest()
+			nfa := MustCompile(pattern)
+			nfaLongest := MustCompile(pattern)
+			nfaLongest.Longest()
+			dfa := NewDFA(MustCompile(pattern))
+
+			for _, input := range inputs {
+				expected := re.FindAllStringIndex(input, -1)
+				if got := nfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: got:%v, wanted:%v", pattern, input, got, expected)
+				}
+				expected = reLongest.FindAllStringIndex(input, -1)
+				if got := nfaLongest.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: got longest:%v, wanted:%v", pattern, input, got, expected)
+				}
+				if got := dfa.FindAllIndex([]byte(input), -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: gotDfa:%v, wanted:%v", pattern, input, got, expected)
+				}
+			}
+		}
+	})
+}
+
+func TestSubmatch(t *testing.T) {
+	t.Run("named groups", func(t *testing.T) {
+		nfa := MustCompile(`(?P<key>[a-z]+)=(?<value>[0-9]*)(?:;|$)?`)
+
+		if nfa.NumSubexp() != 2 {
+			t.Errorf("expected 2 groups, got %d", nfa.NumSubexp())
+		}
+		if names := nfa.SubexpNames(); !reflect.DeepEqual(names, []string{"", "key", "value"}) {
+			t.Errorf("got names:%v", names)
+		}
+		if i := nfa.SubexpIndex("value"); i != 2 {
+			t.Errorf("expected value to be group 2, got %d", i)
+		}
+
+		got := nfa.FindStringSubmatch("# retries=3;")
+		expected := []string{"retries=3;", "retries", "3"}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%q, wanted:%q", got, expected)
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{
+			"(a)(b)?", "(a|ab)(c|bcd)(d*)", "(a*)+", "(a*)*b", "(a)*b", "((a)|b)+", "(?:(a)|(b))+c",
+			"x(y(z)?)*", "(a+)(a{2})", "([0-9]+)-([0-9]+)?", "(a?)((ab)?)(b?)", "()",
+			"(((a){0})+)?", "(a){0}(b)", "(a)(b){0}",
+		}
+		inputs := []string{"", "ab", "abcd", "aaab", "b", "abbac", "xyyz", "aaaaa", "12-34 5-", "aabb"}
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(pattern)
+			nfa := MustCompile(pattern)
+			if nfa.NumSubexp() != re.NumSubexp() {
+				t.Errorf("pattern %q: got %d groups, wanted %d", pattern, nfa.NumSubexp(), re.NumSubexp())
+			}
+
+			for _, input := range inputs {
+				expected := re.FindStringSubmatchIndex(input)
+				if got := nfa.FindStringSubmatchIndex(input); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: got:%v, wanted:%v", pattern, input, got, expected)
+				}
+				expectedAll := re.FindAllStringSubmatchIndex(input, -1)
+				if got := nfa.FindAllStringSubmatchIndex(input, -1); !reflect.DeepEqual(got, expectedAll) {
+					t.Errorf("pattern %q input %q: got all:%v, wanted:%v", pattern, input, got, expectedAll)
+				}
+			}
+		}
+	})
+
+	t.Run("group syntax errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			code    ErrorCode
+			offset  int
+			token   string
+		}{
+			{"(?P<1a-b>x)", ErrInvalidNamedCapture, 0, "(?P<1a-b>"},
+			{"(?P<name", ErrInvalidNamedCapture, 0, "(?P<name"},
+			{"(?<>x)", ErrInvalidNamedCapture, 0, "(?<>"},
+			{"(?P<a>x)(?P<a>y)", ErrDuplicateName, 8, "(?P<a>"},
+			{"(?=x)", ErrInvalidPerlOp, 0, "(?="},
+			{"(?:ab", ErrMissingParen, 0, "("},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != test.code || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, test.code, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestMatchesLinear(t *testing.T) {
+	tests := []struct {
+		pattern        string
+		testStr        string
+		expectedResult bool
+	}{
+		{"(a*)*b", strings.Repeat("a", 5000), false},
+		{"(a*)*b", strings.Repeat("a", 5000) + "b", true},
+		{"(a|aa)*c", strings.Repeat("a", 5000), false},
+		{"(x+x+)+y", strings.Repeat("x", 5000), false},
+		{"[a-z]*", strings.Repeat("abc", 1000000), true},
+		{"(ab)*", strings.Repeat("ab", 1000000) + "a", false},
+	}
+
+	for _, test := range tests {
+		nfa := MustCompile(test.pattern)
+		got := nfa.Matches(test.testStr)
+		if got != test.expectedResult {
+			t.Errorf("pattern %q on %d runes: got:%v, wanted:%v", test.pattern, len(test.testStr), got, test.expectedResult)
+		}
+	}
+
+	t.Run("dfa search", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			expected []int
+		}{
+			{"a*b", strings.Repeat("a", 200000), nil},
+			{"a*b", strings.Repeat("a", 200000) + "b", []int{0, 200001}},
+			{"(a|b)*abb", strings.Repeat("ab", 100000), nil},
+			{"x[a-z]*y", strings.Repeat("xa", 100000) + "y", []int{0, 200001}},
+			{"\\bab", strings.Repeat("a", 200000), nil},
+			{"ERROR [0-9]+", strings.Repeat("INFO 42 ", 50000) + "ERROR 7", []int{400000, 400007}},
+		}
+
+		for _, test := range tests {
+			dfa := NewDFA(MustCompile(test.pattern))
+			if got := dfa.FindStringIndex(test.testStr); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("pattern %q on %d runes: gotDfa:%v, wanted:%v", test.pattern, len(test.testStr), got, test.expected)
+			}
+		}
+	})
+}
+
+func TestMinimize(t *testing.T) {
+	tests := []struct {
+		pattern string
+		states  int
+	}{
+		{"(a|b)*abb", 4},
+		{"(a|b)*", 1},
+		{"a|b", 2},
+		{"ab|cb", 3},
+		{"(a*)*b", 2},
+		{"x{3}", 4},
+		{"[0-9]+(\\.[0-9]+)?", 4},
+		{"[^a]", 2},
+		{"(a|b)*a(a|b){3}", 16},
+	}
+	inputs := []string{"", "a", "b", "ab", "abb", "aabb", "babb", "abab", "cb", "xxx", "xxxx", "3.14", "3.", "42", "aaaa", "abaa", "é"}
+
+	for _, test := range tests {
+		nfa := MustCompile(test.pattern)
+		dfa := NewDFA(nfa)
+		hopcroft := dfa.Minimize()
+		brzozowski := dfa.MinimizeBrzozowski()
+
+		if got := len(hopcroft.GetTransitionTable()); got != test.states {
+			t.Errorf("pattern %q: Minimize gave %d states, wanted %d", test.pattern, got, test.states)
+		}
+		if got := len(brzozowski.GetTransitionTable()); got != test.states {
+			t.Errorf("pattern %q: MinimizeBrzozowski gave %d states, wanted %d", test.pattern, got, test.states)
+		}
+
+		for _, input := range inputs {
+			expected := nfa.Matches(input)
+			if got := hopcroft.Matches(input); got != expected {
+				t.Errorf("pattern %q test %q: Minimize got:%v, wanted:%v", test.pattern, input, got, expected)
+			}
+			if got := brzozowski.Matches(input); got != expected {
+				t.Errorf("pattern %q test %q: MinimizeBrzozowski got:%v, wanted:%v", test.pattern, input, got, expected)
+			}
+		}
+	}
+}
+
+func TestDeterministicDFA(t *testing.T) {
+	t.Run("string", func(t *testing.T) {
+		dfa := NewDFA(MustCompile("[a-c]x|[b-d]y"))
+		expected := "start: 1\naccepting: 5,6\n1: a->2 [b-c]->3 d->4\n2: x->5\n3: x->5 y->6\n4: y->6\n5:\n6:\n"
+		if got := dfa.String(); got != expected {
+			t.Errorf("got:\n%s\nwanted:\n%s", got, expected)
+		}
+	})
+
+	t.Run("repeated compilation", func(t *testing.T) {
+		patterns := []string{"(a|b)*abb", "(a|b)*a(a|b){3}", "[0-9]+(\\.[0-9]+)?|[a-z_][a-z0-9_]*", "((a|b)(c|d))*e?"}
+
+		for _, pattern := range patterns {
+			first := NewDFA(MustCompile(pattern))
+			for range 20 {
+				dfa := NewDFA(MustCompile(pattern))
+				if dfa.startState != "1" {
+					t.Errorf("pattern %q: start state is %q", pattern, dfa.startState)
+				}
+				if dfa.String() != first.String() {
+					t.Fatalf("pattern %q: tables differ:\n%s\nand\n%s", pattern, first, dfa)
+				}
+				if !reflect.DeepEqual(dfa.originalTransitonTable, first.originalTransitonTable) {
+					t.Fatalf("pattern %q: subset labels differ", pattern)
+				}
+			}
+		}
+	})
+}
+
+func TestDenseDFA(t *testing.T) {
+	patterns := []string{"(a|b)*abb", "[0-9]+(\\.[0-9]+)?", "[^a-z]+", "x{2,4}", "(é|ü)+.", "", "a*", "(^a|b)+$"}
+	inputs := []string{"", "abb", "aabb", "ab", "3.14", "3.", "ABC 1", "abc", "xx", "xxxxx", "éüx", "ü", "aaa", "\xff"}
+
+	for _, pattern := range patterns {
+		nfa := MustCompile(pattern)
+		dfa := NewDFA(nfa)
+		dense := NewDenseDFA(dfa)
+		if dense.NumStates() != len(dfa.GetTransitionTable())+1 {
+			t.Errorf("pattern %q: got %d states, wanted %d", pattern, dense.NumStates(), len(dfa.GetTransitionTable())+1)
+		}
+
+		for _, input := range inputs {
+			expected := nfa.Matches(input)
+			if got := dense.Matches(input); got != expected {
+				t.Errorf("pattern %q test %q: gotDense:%v, wanted:%v", pattern, input, got, expected)
+			}
+		}
+	}
+
+	dense := NewDenseDFA(NewDFA(MustCompile("[a-zé]+[0-9]*")))
+	allocs := testing.AllocsPerRun(100, func() {
+		dense.Matches("motörhead42")
+		dense.Matches("café2024")
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+var benchmarkInput = strings.Repeat("user_42@example.com ", 500) + "x"
+
+func BenchmarkDFAMatches(b *testing.B) {
+	dfa := NewDFA(MustCompile("([a-z0-9_]+@[a-z]+\\.[a-z]+ )*x"))
+	b.ReportAllocs()
+	for b.Loop() {
+		dfa.Matches(benchmarkInput)
+	}
+}
+
+func BenchmarkDenseDFAMatches(b *testing.B) {
+	dense := NewDenseDFA(NewDFA(MustCompile("([a-z0-9_]+@[a-z]+\\.[a-z]+ )*x")))
+	b.ReportAllocs()
+	for b.Loop() {
+		dense.Matches(benchmarkInput)
+	}
+}
+
+func TestLazyDFA(t *testing.T) {
+	t.Run("agrees with nfa", func(t *testing.T) {
+		patterns := []string{"(a|b)*abb", "[0-9]+(\\.[0-9]+)?", "(a|b)*a(a|b){3}", "", "x*y|z"}
+		inputs := []string{"", "abb", "babb", "abab", "3.14", "aaaa", "abbb", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbabab", "xxy", "z", "zz"}
+
+		for _, pattern := range patterns {
+			nfa := MustCompile(pattern)
+			for _, cacheSize := range []int{1, 2, 3, 8, 1000} {
+				dfa := NewDFA(MustCompile(pattern), WithLazyCache(cacheSize))
+				for _, input := range inputs {
+					expected := nfa.Matches(input)
+					if got := dfa.Matches(input); got != expected {
+						t.Errorf("pattern %q cache %d test %q: gotLazy:%v, wanted:%v", pattern, cacheSize, input, got, expected)
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("exponential subset construction", func(t *testing.T) {
+		// the eager DFA for this pattern has over two million states
+		pattern := "(a|b)*a(a|b){20}"
+		nfa := MustCompile(pattern)
+
+		var input strings.Builder
+		for i := range 20000 {
+			input.WriteByte("ab"[(i*i/3+i/7)%2])
+		}
+
+		dfa := NewDFA(MustCompile(pattern), WithLazyCache(1000))
+		for _, suffix := range []string{"", "a" + strings.Repeat("b", 20), "a" + strings.Repeat("b", 19)} {
+			str := input.String() + suffix
+			if got, expected := dfa.Matches(str), nfa.Matches(str); got != expected {
+				t.Errorf("suffix %q: gotLazy:%v, wanted:%v", suffix, got, expected)
+			}
+		}
+		if len(dfa.lazy.cache) > 1000 {
+			t.Errorf("cache grew to %d states", len(dfa.lazy.cache))
+		}
+
+		small := NewDFA(MustCompile(pattern), WithLazyCache(4))
+		str := input.String() + "a" + strings.Repeat("b", 20)
+		if !small.Matches(str) {
+			t.Errorf("expected a match with a thrashing cache")
+		}
+		if small.lazy.fallbacks == 0 {
+			t.Errorf("expected the thrashing cache to fall back to the nfa")
+		}
+	})
+
+	t.Run("flushes a full cache", func(t *testing.T) {
+		dfa := NewDFA(MustCompile("(a|b)*a(a|b)"), WithLazyCache(2))
+		str := strings.Repeat("b", 100) + "ab"
+		if !dfa.Matches(str) {
+			t.Errorf("expected %q to match", str)
+		}
+		if dfa.lazy.flushes == 0 || dfa.lazy.fallbacks != 0 {
+			t.Errorf("expected a flush and no fallback, got %d flushes and %d fallbacks", dfa.lazy.flushes, dfa.lazy.fallbacks)
+		}
+	})
+
+	t.Run("keeps flushing over many calls", func(t *testing.T) {
+		pattern := "(a|b)*a(a|b){3}"
+		nfa := MustCompile(pattern)
+		dfa := NewDFA(MustCompile(pattern), WithLazyCache(4))
+		for i := range 35 {
+			input := ""
+			for j := range 6 {
+				input += string("ab"[(i>>j)&1])
+			}
+			if got, expected := dfa.Matches(input), nfa.Matches(input); got != expected {
+				t.Errorf("test %q: gotLazy:%v, wanted:%v", input, got, expected)
+			}
+		}
+		// the cache is far too small for the 16 states, but it must keep
+		// being refilled instead of leaving every call to the nfa
+		if dfa.lazy.flushes < 5 || dfa.lazy.fallbacks >= 35 {
+			t.Errorf("expected repeated flushes, got %d flushes and %d fallbacks", dfa.lazy.flushes, dfa.lazy.fallbacks)
+		}
+	})
+}
+
+func TestAnchors(t *testing.T) {
+	t.Run("matches", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			flags    Flags
+			testStr  string
+			expected bool
+		}{
+			{"^abc$", 0, "abc", true},
+			{"^abc$", 0, "abcd", false},
+			{`\Aab\z`, 0, "ab", true},
+			{"a^b", 0, "ab", false},
+			{"a$b", 0, "ab", false},
+			{"(^a|b)+", 0, "abab", false},
+			{"(^a|b)+", 0, "abbb", true},
+			{"^*a", 0, "a", true},
+			{"^?$?", 0, "", true},
+			{"a\n^b", 0, "a\nb", false},
+			{"a\n^b", MultiLine, "a\nb", true},
+			{"a$\nb", MultiLine, "a\nb", true},
+			{"a$\nb$", MultiLine, "a\nb", true},
+			{"a\n$", MultiLine, "a\n", true},
+			{"(a$|\n)*", MultiLine, "a\n\na\n", true},
+			{"(a$|\n)*", MultiLine, "aa\n", false},
+			{`a\z`, MultiLine, "a", true},
+			{"\\A\n^", MultiLine, "\n", true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern, WithFlags(test.flags))
+			dfa := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)))
+			got := nfa.Matches(test.testStr)
+			gotDfa := dfa.Matches(test.testStr)
+			gotMinimized := dfa.Minimize().Matches(test.testStr)
+			gotLazy := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)), WithLazyCache(2)).Matches(test.testStr)
+			if got != test.expected || gotDfa != test.expected || gotMinimized != test.expected || gotLazy != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, gotMinimized:%v, gotLazy:%v, wanted:%v",
+					test.pattern, test.testStr, got, gotDfa, gotMinimized, gotLazy, test.expected)
+			}
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{"^a+", "a+$", "^$", "^", "$", `\Aab|b\z`, "(^|b)a", "a(b|$)", "^a*$", "x*$", "(a|^)(b|$)"}
+		inputs := []string{"", "a", "aab\nab", "ba\nbab\n", "\n\n", "ab\nb\na", "aaa\nbbb"}
+
+		for _, pattern := range patterns {
+			for _, flags := range []Flags{0, MultiLine} {
+				rePattern := pattern
+				if flags&MultiLine != 0 {
+					rePattern = "(?m)" + pattern
+				}
+				re := regexp.MustCompile(rePattern)
+				reLongest := regexp.MustCompile(rePattern)
+				reLongest.Longest()
+				nfa := MustCompile(pattern, WithFlags(flags))
+				dfa := NewDFA(MustCompile(pattern, WithFlags(flags)))
+				minimized := dfa.Minimize()
+				reWhole := regexp.MustCompile(`^(?:` + rePattern + `)$`)
+
+				for _, input := range inputs {
+					expected := re.FindAllStringIndex(input, -1)
+					if got := nfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+						t.Errorf("pattern %q input %q: got:%v, wanted:%v", rePattern, input, got, expected)
+					}
+					expected = reLongest.FindAllStringIndex(input, -1)
+					if got := dfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+						t.Errorf("pattern %q input %q: gotDfa:%v, wanted:%v", rePattern, input, got, expected)
+					}
+					if got := minimized.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+						t.Errorf("pattern %q input %q: gotMinimized:%v, wanted:%v", rePattern, input, got, expected)
+					}
+					if got, expected := nfa.Matches(input), reWhole.MatchString(input); got != expected {
+						t.Errorf("pattern %q input %q: got match:%v, wanted:%v", rePattern, input, got, expected)
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestWordBoundary(t *testing.T) {
+	t.Run("matches", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			expected bool
+		}{
+			{`\bab\b`, "ab", true},
+			{`a\bb`, "ab", false},
+			{`a\Bb`, "ab", true},
+			{`a\b b`, "a b", true},
+			{`a \Bb`, "a b", false},
+			{`\B`, "", true},
+			{`\b`, "", false},
+			{`(a|\b )*`, "a a a", true},
+			{`(a|\b )*`, "a  a", false},
+			{`.\b.`, "é!", false},
+			{`.\B.`, "é!", true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			dfa := NewDFA(MustCompile(test.pattern))
+			got := nfa.Matches(test.testStr)
+			gotDfa := dfa.Matches(test.testStr)
+			gotMinimized := dfa.Minimize().Matches(test.testStr)
+			gotDense := NewDenseDFA(dfa).Matches(test.testStr)
+			if got != test.expected || gotDfa != test.expected || gotMinimized != test.expected || gotDense != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, gotMinimized:%v, gotDense:%v, wanted:%v",
+					test.pattern, test.testStr, got, gotDfa, gotMinimized, gotDense, test.expected)
+			}
+		}
+	})
+
+	t.Run("whole words", func(t *testing.T) {
+		nfa := MustCompile(`\bERROR\b`)
+		dfa := NewDFA(MustCompile(`\bERROR\b`))
+		line := "ERRORS: 2, last ERROR_CODE=7 ERROR at boot"
+		expected := [][]int{{29, 34}}
+		if got := nfa.FindAllStringIndex(line, -1); !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%v, wanted:%v", got, expected)
+		}
+		if got := dfa.FindAllStringIndex(line, -1); !reflect.DeepEqual(got, expected) {
+			t.Errorf("gotDfa:%v, wanted:%v", got, expected)
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{`\b`, `\B`, `\b[a-z]+\b`, `\Ba+`, `a+\B`, `\b(a|b)*\b`, `(\w+)\b([^a-z]*)`, `^\b|\b$`, `x?\B`}
+		inputs := []string{"", "a", "ab ba", " ab_9!b ", "aa\nbb", "é a é", "a-b-c"}
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(pattern)
+			reLongest := regexp.MustCompile(pattern)
+			reLongest.Longest()
+			nfa := MustCompile(pattern)
+			dfa := NewDFA(MustCompile(pattern))
+			minimized := dfa.Minimize()
+
+			for _, input := range inputs {
+				expected := re.FindAllStringSubmatchIndex(input, -1)
+				if got := nfa.FindAllStringSubmatchIndex(input, -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: got:%v, wanted:%v", pattern, input, got, expected)
+				}
+				expected = reLongest.FindAllStringIndex(input, -1)
+				if got := dfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: gotDfa:%v, wanted:%v", pattern, input, got, expected)
+				}
+				if got := minimized.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: gotMinimized:%v, wanted:%v", pattern, input, got, expected)
+				}
+			}
+		}
+	})
+}
+
+func TestPerlClasses(t *testing.T) {
+	isWord := func(ch rune) bool {
+		return unicode.IsLetter(ch) || unicode.IsMark(ch) || unicode.IsDigit(ch) || unicode.Is(unicode.Pc, ch)
+	}
+	tests := []struct {
+		class     string
+		flags     Flags
+		predicate func(rune) bool
+	}{
+		{`\d`, 0, func(ch rune) bool { return '0' <= ch && ch <= '9' }},
+		{`\w`, 0, isWordChar},
+		{`\s`, 0, func(ch rune) bool { return strings.ContainsRune("\t\n\f\r ", ch) }},
+		{`\d`, UnicodeClasses, unicode.IsDigit},
+		{`\w`, UnicodeClasses, isWord},
+		{`\s`, UnicodeClasses, unicode.IsSpace},
+	}
+
+	var runes []rune
+	for ch := rune(0); ch < 0x3100; ch++ {
+		runes = append(runes, ch)
+	}
+	runes = append(runes, 0xa620, 0xff10, 0xff3f, 0x1d7ce, 0x10ffff)
+
+	for _, test := range tests {
+		negated := strings.ToUpper(test.class)
+		patterns := []struct {
+			pattern string
+			negated bool
+		}{
+			{test.class, false},
+			{negated, true},
+			{"[" + test.class + "]", false},
+			{"[^" + test.class + "]", true},
+			{"[" + negated + "]", true},
+			{"[^" + negated + "]", false},
+		}
+
+		for _, p := range patterns {
+			nfa := MustCompile(p.pattern, WithFlags(test.flags))
+			dfa := NewDFA(MustCompile(p.pattern, WithFlags(test.flags)))
+			for _, ch := range runes {
+				expected := test.predicate(ch) != p.negated
+				if got := nfa.Matches(string(ch)); got != expected {
+					t.Errorf("pattern %q flags %d rune %U: got:%v, wanted:%v", p.pattern, test.flags, ch, got, expected)
+				}
+				if got := dfa.Matches(string(ch)); got != expected {
+					t.Errorf("pattern %q flags %d rune %U: gotDfa:%v, wanted:%v", p.pattern, test.flags, ch, got, expected)
+				}
+			}
+		}
+	}
+
+	if !MustCompile(`\w+`).Matches("jump_j0") {
+		t.Errorf("expected \\w to match every ASCII letter")
+	}
+}
+
+func TestUnicodeProperties(t *testing.T) {
+	t.Run("classes", func(t *testing.T) {
+		tests := []struct {
+			pattern   string
+			predicate func(rune) bool
+		}{
+			{`\p{L}`, unicode.IsLetter},
+			{`\pL`, unicode.IsLetter},
+			{`\p{Lu}`, unicode.IsUpper},
+			{`\p{Nd}`, unicode.IsDigit},
+			{`\p{Greek}`, func(ch rune) bool { return unicode.Is(unicode.Greek, ch) }},
+			{`\P{Han}`, func(ch rune) bool { return !unicode.Is(unicode.Han, ch) }},
+			{`\p{^Han}`, func(ch rune) bool { return !unicode.Is(unicode.Han, ch) }},
+			{`[\p{Greek}\d]`, func(ch rune) bool { return unicode.Is(unicode.Greek, ch) || '0' <= ch && ch <= '9' }},
+			{`[^\P{Lu}a]`, unicode.IsUpper},
+			{`\p{Any}`, func(rune) bool { return true }},
+		}
+
+		var runes []rune
+		for ch := rune(0); ch < 0x3100; ch += 3 {
+			runes = append(runes, ch)
+		}
+		runes = append(runes, 0x4e2d, 0x6587, 0x1d6a8, 0x20000, 0x10ffff)
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			dfa := NewDFA(MustCompile(test.pattern))
+			for _, ch := range runes {
+				expected := test.predicate(ch)
+				if got := nfa.Matches(string(ch)); got != expected {
+					t.Errorf("pattern %q rune %U: got:%v, wanted:%v", test.pattern, ch, got, expected)
+				}
+				if got := dfa.Matches(string(ch)); got != expected {
+					t.Errorf("pattern %q rune %U: gotDfa:%v, wanted:%v", test.pattern, ch, got, expected)
+				}
+			}
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{`\p{Greek}+`, `\p{Lu}\p{Ll}*`, `\P{L}+`, `[\p{Han}\p{Hiragana}]+`, `\p{Cyrillic}+\s\p{Nd}`}
+		input := "Ωμέγα and Привет 42, 中文 ひらがな, ABC Édith"
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(pattern)
+			reLongest := regexp.MustCompile(pattern)
+			reLongest.Longest()
+			nfa := MustCompile(pattern)
+			dfa := NewDFA(MustCompile(pattern))
+
+			expected := re.FindAllStringIndex(input, -1)
+			if got := nfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+				t.Errorf("pattern %q: got:%v, wanted:%v", pattern, got, expected)
+			}
+			expected = reLongest.FindAllStringIndex(input, -1)
+			if got := dfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+				t.Errorf("pattern %q: gotDfa:%v, wanted:%v", pattern, got, expected)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			offset  int
+			token   string
+		}{
+			{`\p{Klingon}`, 0, `\p{Klingon}`},
+			{`a\p{Greek`, 1, `\p{Greek`},
+			{`\p`, 0, `\p`},
+			{`[a\pX]`, 2, `\pX`},
+			{`[a-\pL]`, 1, `a-\pL`},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != ErrInvalidCharRange || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted offset %d token %q", test.pattern, syntaxErr, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestUTF8(t *testing.T) {
+	t.Run("patterns", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			expected bool
+		}{
+			{"é+", "ééé", true},
+			{"é+", "é\xa9", false},
+			{"caf(é|e)?", "café", true},
+			{"[é-ü]{2}", "ñö", true},
+			{"[^é]", "é", false},
+			{"日本語?", "日本", true},
+			{"(?P<名前>語)", "語", true},
+			{"ε", "ε", true},
+			{"ε", "", false},
+			{"aε", "a", false},
+			{"aε", "aε", true},
+			{"ε*", "εε", true},
+			{"[ε]", "ε", true},
+			{"(?i)ε", "Ε", true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			dfa := NewDFA(MustCompile(test.pattern))
+			if got := nfa.Matches(test.testStr); got != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expected)
+			}
+			if got := dfa.Matches(test.testStr); got != test.expected {
+				t.Errorf("pattern %q test %q: gotDfa:%v, wanted:%v", test.pattern, test.testStr, got, test.expected)
+			}
+		}
+	})
+
+	t.Run("invalid patterns", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			offset  int
+		}{
+			{"\xff", 0},
+			{"ab\xe9+", 2},
+			{"[a\xc3]", 2},
+			{"é\xa9", 2},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != ErrInvalidUTF8 || syntaxErr.Offset != test.offset || syntaxErr.Token != test.pattern[test.offset:test.offset+1] {
+				t.Errorf("pattern %q: got %v, wanted offset %d", test.pattern, syntaxErr, test.offset)
+			}
+		}
+	})
+
+	t.Run("invalid subjects", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			expected bool
+		}{
+			{"a.b", "a\xffb", true},
+			{"a..b", "a\xe6\x97b", true},
+			{"a.b", "a\xe6\x97b", false},
+			{"a�b", "a\xffb", true},
+			{"[^a]+", "\xff\xfe", true},
+			{"\\P{L}", "\xff", true},
+			{"é", "\xc3", false},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			dfa := NewDFA(MustCompile(test.pattern))
+			got := nfa.Matches(test.testStr)
+			gotDfa := dfa.Matches(test.testStr)
+			gotDense := NewDenseDFA(dfa).Matches(test.testStr)
+			gotLazy := NewDFA(MustCompile(test.pattern), WithLazyCache(8)).Matches(test.testStr)
+			if got != test.expected || gotDfa != test.expected || gotDense != test.expected || gotLazy != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, gotDense:%v, gotLazy:%v, wanted:%v",
+					test.pattern, test.testStr, got, gotDfa, gotDense, gotLazy, test.expected)
+			}
+		}
+
+		input := "x\xffé\xe6\x97y"
+		for _, pattern := range []string{".", "[^x]+", "\\b", "�"} {
+			expected := regexp.MustCompile(pattern).FindAllStringIndex(input, -1)
+			if got := MustCompile(pattern).FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+				t.Errorf("pattern %q: got:%v, wanted:%v", pattern, got, expected)
+			}
+			if got := NewDFA(MustCompile(pattern)).FindAllIndex([]byte(input), -1); !reflect.DeepEqual(got, expected) {
+				t.Errorf("pattern %q: gotDfa:%v, wanted:%v", pattern, got, expected)
+			}
+		}
+	})
+}
+
+func TestBytes(t *testing.T) {
+	t.Run("matches", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			flags    Flags
+			testStr  []byte
+			expected bool
+		}{
+			{`(?-u)\xff\x00+`, 0, []byte{0xff, 0, 0}, true},
+			{`\xff\x00+`, Bytes, []byte{0xff, 0, 0}, true},
+			{`\xff\x00+`, 0, []byte{0xff, 0, 0}, false},
+			{`\xe9`, 0, []byte("é"), true},
+			{`(?-u)\xe9`, 0, []byte("é"), false},
+			{`(?-u).`, 0, []byte{0xc3}, true},
+			{`(?-u).`, 0, []byte("é"), false},
+			{`(?-u)..`, 0, []byte("é"), true},
+			{`(?-u)é+`, 0, []byte("éé"), true},
+			{`(?-u)é+`, 0, []byte{0xc3, 0xa9, 0xa9}, false},
+			{`(?-u)[^a]`, 0, []byte{0xff}, true},
+			{`(?-u)[^a]`, 0, []byte("é"), false},
+			{`(?-u)\W\w`, 0, []byte{0xe9, 'x'}, true},
+			{`(?-u)\b\xe9`, 0, []byte{0xe9}, false},
+			{`(?-u)(?s).+`, 0, []byte{'\n', 0x80, 0}, true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern, WithFlags(test.flags))
+			dfa := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)))
+			got := nfa.MatchBytes(test.testStr)
+			gotDfa := dfa.MatchBytes(test.testStr)
+			gotDense := NewDenseDFA(dfa.Minimize()).MatchBytes(test.testStr)
+			gotLazy := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)), WithLazyCache(4)).MatchBytes(test.testStr)
+			if got != test.expected || gotDfa != test.expected || gotDense != test.expected || gotLazy != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, gotDense:%v, gotLazy:%v, wanted:%v",
+					test.pattern, test.testStr, got, gotDfa, gotDense, gotLazy, test.expected)
+			}
+			if got := nfa.Matches(string(test.testStr)); got != test.expected {
+				t.Errorf("pattern %q test %q: got string:%v, wanted:%v", test.pattern, test.testStr, got, test.expected)
+			}
+		}
+	})
+
+	t.Run("frames", func(t *testing.T) {
+		frames := []byte{0x00, 0x02, 0xff, 0xfe, 0x03, 0x10, 0x02, 0xc3, 0x03}
+		nfa := MustCompile(`\x02[^\x03]*\x03`, WithFlags(Bytes))
+		dfa := NewDFA(MustCompile(`\x02[^\x03]*\x03`, WithFlags(Bytes)))
+		expected := [][]int{{1, 5}, {6, 9}}
+
+		if got := nfa.FindIndex(frames); !reflect.DeepEqual(got, expected[0]) {
+			t.Errorf("got:%v, wanted:%v", got, expected[0])
+		}
+		if got := nfa.FindAllIndex(frames, -1); !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%v, wanted:%v", got, expected)
+		}
+		if got := dfa.FindAllIndex(frames, -1); !reflect.DeepEqual(got, expected) {
+			t.Errorf("gotDfa:%v, wanted:%v", got, expected)
+		}
+		if got := MustCompile(`(?-u)\B`).FindAllIndex([]byte{0xe9, 0xe9}, -1); !reflect.DeepEqual(got, [][]int{{0, 0}, {1, 1}, {2, 2}}) {
+			t.Errorf("got:%v, wanted every position", got)
+		}
+	})
+
+	t.Run("flag groups", func(t *testing.T) {
+		patterns := []string{"(?s:a.)b", "(?m)^x$", "a(?s:.)(?-s).?", "(?ms)^.+$", "(x(?m)$)|y$", "(?m:^b)|^a"}
+		inputs := []string{"", "a\nb", "x\nx", "xa\n\n", "y\nx\ny", "ab\nba"}
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(pattern)
+			nfa := MustCompile(pattern)
+			for _, input := range inputs {
+				expected := re.FindAllStringIndex(input, -1)
+				if got := nfa.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, expected) {
+					t.Errorf("pattern %q input %q: got:%v, wanted:%v", pattern, input, got, expected)
+				}
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			code    ErrorCode
+			offset  int
+			token   string
+		}{
+			{`(?-u)[é]`, ErrInvalidCharRange, 6, "é"},
+			{`(?-u)\pL`, ErrInvalidCharRange, 5, `\p`},
+			{`a(?-u)`, ErrInvalidPerlOp, 1, "(?-u"},
+			{`(?-u)(?u)`, ErrInvalidPerlOp, 5, "(?u"},
+			{`(?z)`, ErrInvalidPerlOp, 0, "(?z"},
+			{`(?m-)`, ErrInvalidPerlOp, 0, "(?m-)"},
+			{`\xZZ`, ErrInvalidEscape, 0, `\xZZ`},
+			{`[\x4]`, ErrInvalidEscape, 1, `\x4]`},
+			{`a\x`, ErrInvalidEscape, 1, `\x`},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != test.code || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, test.code, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestFoldCase(t *testing.T) {
+	t.Run("matches", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			flags    Flags
+			testStr  string
+			expected bool
+		}{
+			{"(?i)error", 0, "ERROR", true},
+			{"(?i)error", 0, "eRrOr", true},
+			{"error", FoldCase, "Error", true},
+			{"(?i:e)rror", 0, "Error", true},
+			{"(?i:e)rror", 0, "ERROR", false},
+			{"a(?i)b|c", 0, "aB", true},
+			{"a(?i)b|c", 0, "C", true},
+			{"(a(?i)b)c", 0, "aBc", true},
+			{"(a(?i)b)c", 0, "aBC", false},
+			{"(?i)k", 0, "\u212a", true},
+			{"(?i)ſ", 0, "S", true},
+			{"(?i)σ+", 0, "Σσς", true},
+			{"(?i)[a-c]+", 0, "AbC", true},
+			{"(?i)[^k]", 0, "K", false},
+			{"(?i)[^k]", 0, "\u212a", false},
+			{"(?i)\\w", 0, "\u212a", true},
+			{"(?i)\\W", 0, "\u212a", false},
+			{"(?i)\\p{Lu}+", 0, "aB", true},
+			{"(?i)\\P{Lu}", 0, "a", false},
+			{"(?i)é", 0, "É", true},
+			{"(?i)\\x64", 0, "D", true},
+			{"\\x64", 0, "1", false},
+			{"(?-u)(?i)\\xe9", 0, "\xc9", false},
+			{"(?-u)(?i)k", 0, "K", true},
+			{"(?-u)(?i)k", 0, "\u212a", false},
+			{"(?-u)(?i)[a-z]+", 0, "aZ", true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern, WithFlags(test.flags))
+			dfa := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)))
+			got := nfa.Matches(test.testStr)
+			gotDfa := dfa.Matches(test.testStr)
+			if got != test.expected || gotDfa != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, wanted:%v", test.pattern, test.testStr, got, gotDfa, test.expected)
+			}
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{`(?i)k`, `(?i)[a-z]`, `(?i)[^a-z]`, `(?i)\w`, `(?i)\W`, `(?i)\S`, `(?i)\p{Greek}`, `(?i)\P{Ll}`, `(?i)[ǅ-ǉ]`, `(?i)[Ā-ſ]`}
+		var runes []rune
+		for ch := rune(0); ch < 0x600; ch++ {
+			runes = append(runes, ch)
+		}
+		runes = append(runes, 0x1e9e, 0x212a, 0x212b, 0x2126, 0xa7ae, 0x10400, 0x10428, 0x1e900, 0x1e922)
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(`^(?:` + pattern + `)$`)
+			nfa := MustCompile(pattern)
+			dfa := NewDFA(MustCompile(pattern))
+			for _, ch := range runes {
+				expected := re.MatchString(string(ch))
+				if got := nfa.Matches(string(ch)); got != expected {
+					t.Errorf("pattern %q rune %U: got:%v, wanted:%v", pattern, ch, got, expected)
+				}
+				if got := dfa.Matches(string(ch)); got != expected {
+					t.Errorf("pattern %q rune %U: gotDfa:%v, wanted:%v", pattern, ch, got, expected)
+				}
+			}
+		}
+	})
+}
+
+func TestEscapes(t *testing.T) {
+	t.Run("matches", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			expected bool
+		}{
+			{`a\nb`, "a\nb", true},
+			{`a\nb`, "anb", false},
+			{`\t\r\f\v\a`, "\t\r\f\v\a", true},
+			{`\0`, "\x00", true},
+			{`\0`, "0", false},
+			{`\101\0101`, "AA", false},
+			{`\101\01011`, "A\b11", true},
+			{`\x41`, "A", true},
+			{`\x{41}`, "A", true},
+			{`\x{1F600}`, "😀", true},
+			{`é`, "é", true},
+			{`é1`, "é1", true},
+			{`[\x{100}-\x{17f}]+`, "ĀſŁ", true},
+			{`[\n\t]+`, "\n\t", true},
+			{`[^\n]`, "\n", false},
+			{`[\0-\x1f]`, "\x1f", true},
+			{`\.\+\\`, `.+\`, true},
+			{`(?i)\x{3a3}`, "ς", true},
+			{`(?-u)\xff`, "\xff", true},
+			{`(?-u)\x{ff}`, "\xff", true},
+			{`(?-u)\377`, "\xff", true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			dfa := NewDFA(MustCompile(test.pattern))
+			got := nfa.MatchBytes([]byte(test.testStr))
+			gotDfa := dfa.MatchBytes([]byte(test.testStr))
+			if got != test.expected || gotDfa != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, wanted:%v", test.pattern, test.testStr, got, gotDfa, test.expected)
+			}
+		}
+	})
+
+	t.Run("agrees with regexp", func(t *testing.T) {
+		patterns := []string{`\n`, `\t\v`, `[\a-\r]`, `\0`, `\07`, `\101`, `\1012`, `\x7f`, `\x{10FFFF}`, `[\x{80}-\x{7ff}]`, `[^\x00-\x{7f}]`, `\x{a}`}
+		strs := []string{"", "\n", "\t\v", "\a", "\r", "\x00", "\x07", "A", "A2", "\x7f", "\U0010ffff", "é", "a", "߿", "ࠀ"}
+
+		for _, pattern := range patterns {
+			re := regexp.MustCompile(`^(?:` + pattern + `)$`)
+			nfa := MustCompile(pattern)
+			dfa := NewDFA(MustCompile(pattern))
+			for _, str := range strs {
+				expected := re.MatchString(str)
+				if got := nfa.Matches(str); got != expected {
+					t.Errorf("pattern %q test %q: got:%v, wanted:%v", pattern, str, got, expected)
+				}
+				if got := dfa.Matches(str); got != expected {
+					t.Errorf("pattern %q test %q: gotDfa:%v, wanted:%v", pattern, str, got, expected)
+				}
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			offset  int
+			token   string
+		}{
+			{`\q`, 0, `\q`},
+			{`a\N`, 1, `\N`},
+			{`[\e]`, 1, `\e`},
+			{`[a\b]`, 2, `\b`},
+			{`\1`, 0, `\1`},
+			{`\8`, 0, `\8`},
+			{`\x{}`, 0, `\x{}`},
+			{`\x{41`, 0, `\x{41`},
+			{`\x{110000}`, 0, `\x{110000}`},
+			{`\x{d800}`, 0, `\x{d800}`},
+			{`\u41`, 0, `\u41`},
+			{`\u00G0`, 0, `\u00G0`},
+			{`(?-u)\x{100}`, 5, `\x{100}`},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != ErrInvalidEscape || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, ErrInvalidEscape, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestConstruction(t *testing.T) {
+	patterns := []string{`(?:a*b)?`, `(?:a*b)*`, `(?:ba*)?`, `(?:ab*)*`, `(?:(?:ab)*c)?`, `(?:a*b*)*c`, `(?:a|b*)+c`, `x?(?:a*|b)*`, `(a*b)*`, `(?:a*b){0,2}`, `(?:b?a*){2,}c`, `^(?:a*\b)*$`}
+	atoms := []string{"a", "ab", "a*b", "ba*", "(?:a|b*)", "(a?b)", "a+b?"}
+	repeats := []string{"(?:%s)*", "(?:%s)+", "(?:%s)?", "(?:%s){0,2}", "(?:%s){2,}"}
+	for _, atom := range atoms {
+		for _, inner := range repeats {
+			for _, outer := range repeats {
+				patterns = append(patterns, fmt.Sprintf(outer, fmt.Sprintf(inner, atom)+"c?"))
+			}
+		}
+	}
+
+	strs := []string{""}
+	for i := 0; i < len(strs) && len(strs[i]) < 5; i++ {
+		for _, ch := range "abc" {
+			strs = append(strs, strs[i]+string(ch))
+		}
+	}
+
+	patterns = append(patterns, `(([ab])?)+`, `(a?)+`, `(a?)*`, `((a)|b)+`, `(a*)+b`, `(a|ab)(c|bcd)?(d*)`, `(?:(a)|(b)c?)+`, `((a?b?)?)+c`)
+
+	for _, pattern := range patterns {
+		re := regexp.MustCompile(`^(?:` + pattern + `)$`)
+		search := regexp.MustCompile(pattern)
+		for _, construction := range []Construction{ShortcutConstruction, ThompsonConstruction} {
+			nfa := MustCompile(pattern, WithConstruction(construction))
+			dfa := NewDFA(MustCompile(pattern, WithConstruction(construction)))
+			for _, str := range strs {
+				expected := re.MatchString(str)
+				got := nfa.Matches(str)
+				gotDfa := dfa.Matches(str)
+				if got != expected || gotDfa != expected {
+					t.Errorf("pattern %q construction %d test %q: got:%v, gotDfa:%v, wanted:%v", pattern, construction, str, got, gotDfa, expected)
+				}
+				expectedSubmatch := search.FindStringSubmatchIndex(str)
+				if got := nfa.FindStringSubmatchIndex(str); !reflect.DeepEqual(got, expectedSubmatch) {
+					t.Errorf("pattern %q construction %d test %q: got submatch:%v, wanted:%v", pattern, construction, str, got, expectedSubmatch)
+				}
+			}
+		}
+	}
+}
+
+func TestProduct(t *testing.T) {
+	operations := []struct {
+		name    string
+		combine func(a, b *DFA) *DFA
+		accept  func(inA, inB bool) bool
+	}{
+		{"Intersect", Intersect, func(inA, inB bool) bool { return inA && inB }},
+		{"Union", Union, func(inA, inB bool) bool { return inA || inB }},
+		{"Difference", Difference, func(inA, inB bool) bool { return inA && !inB }},
+		{"SymmetricDifference", SymmetricDifference, func(inA, inB bool) bool { return inA != inB }},
+	}
+	pairs := []struct {
+		a, b string
+	}{
+		{"(a|b)*abb", "(a|b)*a(a|b)"},
+		{"[a-z]+", "[^aeiou]+"},
+		{"/api/[a-z]+(/[a-z]+)*", "/api/admin(/.*)?"},
+		{"a*", "(aa)*"},
+		{"[0-9]+", "[a-z]+"},
+		{"x{2,4}", "x{3,}"},
+		{"é|ü+", "[^a-z]"},
+		{"", "a?"},
+		{"^ab$|b", "a\\b.*"},
+	}
+	inputs := []string{"", "a", "aa", "aaa", "abb", "aabb", "bab", "abab", "xyz", "bcd", "/api/users", "/api/users/list", "/api/admin", "/api/admin/x", "/api/", "42", "xx", "xxx", "xxxxx", "é", "üü", "ab", "a b"}
+
+	for _, pair := range pairs {
+		reA := regexp.MustCompile(`^(?:` + pair.a + `)$`)
+		reB := regexp.MustCompile(`^(?:` + pair.b + `)$`)
+		a := NewDFA(MustCompile(pair.a))
+		b := NewDFA(MustCompile(pair.b), WithLazyCache(4))
+		for _, op := range operations {
+			dfa := op.combine(a, b)
+			minimized := op.combine(a.Minimize(), b).Minimize()
+			for _, input := range inputs {
+				expected := op.accept(reA.MatchString(input), reB.MatchString(input))
+				if got := dfa.Matches(input); got != expected {
+					t.Errorf("%s(%q, %q) test %q: got:%v, wanted:%v", op.name, pair.a, pair.b, input, got, expected)
+				}
+				if got := minimized.Matches(input); got != expected {
+					t.Errorf("%s(%q, %q) test %q: got minimized:%v, wanted:%v", op.name, pair.a, pair.b, input, got, expected)
+				}
+			}
+		}
+	}
+
+	t.Run("equivalence", func(t *testing.T) {
+		tests := []struct {
+			a, b  string
+			equal bool
+		}{
+			{"(a|b)*", "(a*b*)*", true},
+			{"a(ba)*", "(ab)*a", true},
+			{"[a-c]x|[b-d]x", "[a-d]x", true},
+			{"a+", "a*", false},
+			{"(a|b)*abb", "(a|b)*ab", false},
+		}
+
+		for _, test := range tests {
+			diff := SymmetricDifference(NewDFA(MustCompile(test.a)), NewDFA(MustCompile(test.b)))
+			equal := len(diff.GetAcceptingStateNums()) == 0
+			if equal != test.equal {
+				t.Errorf("%q and %q: got equal:%v, wanted:%v\n%s", test.a, test.b, equal, test.equal, diff)
+			}
+		}
+	})
+
+	t.Run("string", func(t *testing.T) {
+		dfa := Intersect(NewDFA(MustCompile("[a-c]+")), NewDFA(MustCompile("[b-d]x?")))
+		expected := "start: 1\naccepting: 2\n1: [b-c]->2\n2:\n"
+		if got := dfa.String(); got != expected {
+			t.Errorf("got:\n%s\nwanted:\n%s", got, expected)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		dfa := Intersect(NewDFA(MustCompile("a(b|c)")), NewDFA(MustCompile("ab|ac|ad")))
+		if got, expected := dfa.FindStringIndex("xxac"), []int{2, 4}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%v, wanted:%v", got, expected)
+		}
+		if got, expected := dfa.Complement().Complement().FindStringIndex("adab"), []int{2, 4}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%v, wanted:%v", got, expected)
+		}
+
+		// the results only know the strings Matches accepts, which is not
+		// enough to search with assertions
+		tests := []struct {
+			name    string
+			dfa     *DFA
+			testStr string
+		}{
+			{"Intersect", Intersect(NewDFA(MustCompile("^a")), NewDFA(MustCompile("a"))), "ba"},
+			{"Complement", NewDFA(MustCompile(`a\b`)).Complement().Complement(), "ab"},
+			{"MinimizeBrzozowski", NewDFA(MustCompile(`\bab`)).MinimizeBrzozowski().Minimize(), "cab"},
+		}
+
+		for _, test := range tests {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s: expected FindStringIndex(%q) to panic", test.name, test.testStr)
+					}
+				}()
+				test.dfa.FindStringIndex(test.testStr)
+			}()
+		}
+	})
+}
+
+func TestComplement(t *testing.T) {
+	patterns := []string{"(a|b)*abb", "[a-z]+", "", "a*", ".*", "[^a]", "é+|x{2,3}", "^ab$|b", "a\\b.*"}
+	inputs := []string{"", "a", "b", "aa", "abb", "aabb", "xyz", "xx", "xxx", "xxxx", "é", "éé", "ü", "\U0010ffff", "ab", "a b", "\n", "\xff"}
+
+	for _, pattern := range patterns {
+		re := regexp.MustCompile(`^(?:` + pattern + `)$`)
+		dfa := NewDFA(MustCompile(pattern))
+		complement := dfa.Complement()
+		minimized := dfa.Minimize().Complement().Minimize()
+		double := complement.Complement()
+		for _, input := range inputs {
+			expected := !re.MatchString(input)
+			if got := complement.Matches(input); got != expected {
+				t.Errorf("pattern %q test %q: got:%v, wanted:%v", pattern, input, got, expected)
+			}
+			if got := minimized.Matches(input); got != expected {
+				t.Errorf("pattern %q test %q: got minimized:%v, wanted:%v", pattern, input, got, expected)
+			}
+			if got := double.Matches(input); got != !expected {
+				t.Errorf("pattern %q test %q: got double:%v, wanted:%v", pattern, input, got, !expected)
+			}
+		}
+		if diff := SymmetricDifference(dfa, double); len(diff.GetAcceptingStateNums()) != 0 {
+			t.Errorf("pattern %q: double complement differs:\n%s", pattern, diff)
+		}
+		if both := Intersect(dfa, complement); len(both.GetAcceptingStateNums()) != 0 {
+			t.Errorf("pattern %q: complement overlaps:\n%s", pattern, both)
+		}
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		complement := NewDFA(MustCompile("(?-u)[a\\xff]")).Complement()
+		tests := []struct {
+			testStr  string
+			expected bool
+		}{
+			{"a", false},
+			{"\xff", false},
+			{"b", true},
+			{"é", true},
+			{"", true},
+		}
+		for _, test := range tests {
+			if got := complement.MatchBytes([]byte(test.testStr)); got != test.expected {
+				t.Errorf("test %q: got:%v, wanted:%v", test.testStr, got, test.expected)
+			}
+		}
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		dfa := NewDFA(MustCompile("ab")).Complete([]RuneRange{{'a', 'c'}})
+		expected := "start: 1\naccepting: 3\n1: a->2 b->4 c->4\n2: a->4 b->3 c->4\n3: a->4 b->4 c->4\n4: a->4 b->4 c->4\n"
+		if got := dfa.String(); got != expected {
+			t.Errorf("got:\n%s\nwanted:\n%s", got, expected)
+		}
+
+		complete := NewDFA(MustCompile("[a-c]*")).Complete([]RuneRange{{'a', 'c'}})
+		if got := len(complete.GetTransitionTable()); got != 1 {
+			t.Errorf("complete DFA got %d states, wanted 1:\n%s", got, complete)
+		}
+	})
+}
+
+func TestExtended(t *testing.T) {
+	t.Run("agrees with products", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			a, b    string
+			accept  func(inA, inB bool) bool
+		}{
+			{"a.*&.*b", "a.*", ".*b", func(inA, inB bool) bool { return inA && inB }},
+			{"~(.*secret.*)", ".*secret.*", "", func(inA, inB bool) bool { return !inA }},
+			{".*password.*&~(.*secret.*)", ".*password.*", ".*secret.*", func(inA, inB bool) bool { return inA && !inB }},
+			{"[a-z]+&~(.*[aeiou].*)|x", "[b-df-hj-np-tv-z]+", "x", func(inA, inB bool) bool { return inA || inB }},
+			{"(a|b)*&(.*a.*&.*b.*)", "(a|b)*", "(?:.*a.*)(?:.*b.*)|(?:.*b.*)(?:.*a.*)", func(inA, inB bool) bool { return inA && inB }},
+			{"~a*", "a", "", func(inA, inB bool) bool { return !inA }},
+			{"~(a*)", "a*", "", func(inA, inB bool) bool { return !inA }},
+			{"x(~(ab))y", "x.*y", "xaby", func(inA, inB bool) bool { return inA && !inB }},
+			{"(?i)~(.*SECRET.*)", "(?i).*secret.*", "", func(inA, inB bool) bool { return !inA }},
+			{"(~(a))&..", "..", "a", func(inA, inB bool) bool { return inA }},
+		}
+		inputs := []string{"", "a", "b", "ab", "ba", "aab", "abc", "xyz", "my secret", "password", "password secret", "the password is", "SeCrEt", "bcd", "x", "xy", "xaby", "xaay", "xy y", "aa", "a\nb"}
+
+		for _, test := range tests {
+			reA := regexp.MustCompile(`^(?:` + test.a + `)$`)
+			reB := regexp.MustCompile(`^(?:` + test.b + `)$`)
+			nfa := MustCompile(test.pattern, WithFlags(Extended))
+			dfa := NewDFA(MustCompile(test.pattern, WithFlags(Extended)))
+			for _, input := range inputs {
+				expected := test.accept(reA.MatchString(input), reB.MatchString(input))
+				got := nfa.Matches(input)
+				gotDfa := dfa.Matches(input)
+				if got != expected || gotDfa != expected {
+					t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, wanted:%v", test.pattern, input, got, gotDfa, expected)
+				}
+			}
+		}
+	})
+
+	t.Run("literals", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			flags    Flags
+			testStr  string
+			expected bool
+		}{
+			{"a&b", 0, "a&b", true},
+			{"~a", 0, "~a", true},
+			{"~a", 0, "b", false},
+			{"a\\&b", Extended, "a&b", true},
+			{"\\~a", Extended, "~a", true},
+			{"[&~]+", Extended, "&~", true},
+			{"(?-u)~\\xff", Extended, "\xfe", true},
+			{"(?-u)~\\xff", Extended, "\xff", false},
+			{"&a", Extended, "", false},
+			{"a|&", Extended, "", true},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern, WithFlags(test.flags))
+			dfa := NewDFA(MustCompile(test.pattern, WithFlags(test.flags)))
+			got := nfa.MatchBytes([]byte(test.testStr))
+			gotDfa := dfa.MatchBytes([]byte(test.testStr))
+			if got != test.expected || gotDfa != test.expected {
+				t.Errorf("pattern %q test %q: got:%v, gotDfa:%v, wanted:%v", test.pattern, test.testStr, got, gotDfa, test.expected)
+			}
+		}
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		tests := []struct {
+			pattern  string
+			testStr  string
+			names    []string
+			expected []int
+		}{
+			{"(a)&(a)(b)?", "a", []string{""}, []int{0, 1}},
+			{"(x)~(a)(y)", "xby", []string{"", "", ""}, []int{0, 3, 0, 1, 2, 3}},
+			{"(?P<k>x)~(?P<v>a)(?P<v>y)", "xby", []string{"", "k", "v"}, []int{0, 3, 0, 1, 2, 3}},
+			{"(?P<n>a)&(?P<n>a)|(?P<n>b)", "b", []string{"", "n"}, []int{0, 1, 0, 1}},
+			{"(a&a)", "a", []string{"", ""}, []int{0, 1, 0, 1}},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern, WithFlags(Extended))
+			if got := nfa.SubexpNames(); !reflect.DeepEqual(got, test.names) {
+				t.Errorf("pattern %q: got names:%q, wanted:%q", test.pattern, got, test.names)
+			}
+			if got := nfa.NumSubexp(); got != len(test.names)-1 {
+				t.Errorf("pattern %q: got %d groups, wanted %d", test.pattern, got, len(test.names)-1)
+			}
+			if got := nfa.FindStringSubmatchIndex(test.testStr); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("pattern %q test %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expected)
+			}
+		}
+	})
+
+	t.Run("find", func(t *testing.T) {
+		nfa := MustCompile("[a-z]+&~(.*e.*)", WithFlags(Extended))
+		expected := []string{"a", "sql", "lin", "without", "l", "ss", "ls"}
+		if got := nfa.FindAllString("a sql line without less ls", -1); !reflect.DeepEqual(got, expected) {
+			t.Errorf("got:%q, wanted:%q", got, expected)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			pattern string
+			code    ErrorCode
+			offset  int
+			token   string
+		}{
+			{"a~", ErrMissingComplementArgument, 1, "~"},
+			{"(~)", ErrMissingComplementArgument, 1, "~"},
+			{"~|a", ErrMissingComplementArgument, 0, "~"},
+			{"~*", ErrMissingRepeatArgument, 1, "*"},
+			{"~(^a)", ErrAssertInOperand, 0, "~"},
+			{"a&\\bb", ErrAssertInOperand, 1, "&"},
+			{"(a$)&b", ErrAssertInOperand, 4, "&"},
+		}
+
+		for _, test := range tests {
+			_, err := Compile(test.pattern, WithFlags(Extended))
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("pattern %q: expected *SyntaxError, got %v", test.pattern, err)
+			}
+			if syntaxErr.Code != test.code || syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+				t.Errorf("pattern %q: got %v, wanted code %q at %d token %q", test.pattern, syntaxErr, test.code, test.offset, test.token)
+			}
+		}
+	})
+}
+
+func TestConcurrent(t *testing.T) {
+	t.Run("shared nfa", func(t *testing.T) {
+		tests := []struct {
+			pattern        string
+			testStr        string
+			expectedResult bool
+		}{
+			{"(a|b)*c", "abac", true},
+			{"x(y+)z", "axyyz", false},
+			{"\\b(ab)", "cab ab", false},
+		}
+
+		for _, test := range tests {
+			nfa := MustCompile(test.pattern)
+			re := regexp.MustCompile(test.pattern)
+			wantIndex, wantSubmatch := re.FindStringIndex(test.testStr), re.FindStringSubmatchIndex(test.testStr)
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if got := nfa.Matches(test.testStr); got != test.expectedResult {
+						t.Errorf("pattern %q on %q: got:%v, wanted:%v", test.pattern, test.testStr, got, test.expectedResult)
+					}
+					if got := nfa.FindStringIndex(test.testStr); !reflect.DeepEqual(got, wantIndex) {
+						t.Errorf("pattern %q on %q: got:%v, wanted:%v", test.pattern, test.testStr, got, wantIndex)
+					}
+					if got := nfa.FindStringSubmatchIndex(test.testStr); !reflect.DeepEqual(got, wantSubmatch) {
+						t.Errorf("pattern %q on %q: got:%v, wanted:%v", test.pattern, test.testStr, got, wantSubmatch)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+	})
+
+	t.Run("shared lazy dfa", func(t *testing.T) {
+		pattern := "(a|b)*a(a|b){3}"
+		nfa := MustCompile(pattern)
+		dfa := NewDFA(MustCompile(pattern), WithLazyCache(4))
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range 64 {
+					input := ""
+					for k := range 6 {
+						input += string("ab"[((i*64+j)>>k)&1])
+					}
+					if got, expected := dfa.Matches(input), nfa.Matches(input); got != expected {
+						t.Errorf("test %q: gotLazy:%v, wanted:%v", input, got, expected)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
 }
@@ -0,0 +1,98 @@
+package automata
+
+import (
+	"maps"
+	"slices"
+	"unicode/utf8"
+)
+
+// deadState is the state every missing transition of a DenseDFA leads to. It
+// is not accepting and never left.
+const deadState int32 = 0
+
+// DenseDFA is a DFA compiled into a flat table for matching. States are
+// int32 IDs with 0 as the dead state, and symbols are equivalence class IDs
+// with 0 for the runes outside the alphabet, so the successor of state s on
+// class c is table[s*stride+c].
+type DenseDFA struct {
+	alphabet   []RuneRange
+	asciiClass [utf8.RuneSelf]int32
+	stride     int
+	table      []int32
+	accepting  []bool
+	start      int32
+	bytes      bool
+}
+
+func NewDenseDFA(dfa *DFA) *DenseDFA {
+	table := dfa.GetTransitionTable()
+	alphabet := dfa.GetAlphabet()
+	acceptingStateNums := dfa.GetAcceptingStateNums()
+
+	d := DenseDFA{alphabet: alphabet, stride: len(alphabet) + 1, bytes: dfa.bytes}
+	for ch := range rune(utf8.RuneSelf) {
+		d.asciiClass[ch] = d.class(ch)
+	}
+
+	// IDs follow the DFA state numbers, which start at 1 and leave 0 for the
+	// dead state
+	ids := make(map[string]int32, len(table))
+	for i, label := range slices.SortedFunc(maps.Keys(table), compareStateLabels) {
+		ids[label] = int32(i + 1)
+	}
+	numStates := len(table) + 1
+
+	d.start = ids[dfa.startState]
+	d.table = make([]int32, numStates*d.stride)
+	d.accepting = make([]bool, numStates)
+	for label, row := range table {
+		id := ids[label]
+		d.accepting[id] = acceptingStateNums[label]
+		for c, symbol := range alphabet {
+			if next, ok := row[symbol]; ok {
+				d.table[int(id)*d.stride+c+1] = ids[next]
+			}
+		}
+	}
+	return &d
+}
+
+func (d *DenseDFA) class(ch rune) int32 {
+	if c, ok := findRange(d.alphabet, ch); ok {
+		return int32(c + 1)
+	}
+	return 0
+}
+
+func (d *DenseDFA) NumStates() int {
+	return len(d.accepting)
+}
+
+func (d *DenseDFA) Matches(str string) bool {
+	return denseMatches(d, str)
+}
+
+func (d *DenseDFA) MatchBytes(b []byte) bool {
+	return denseMatches(d, b)
+}
+
+func denseMatches[T input](d *DenseDFA, str T) bool {
+	state := d.start
+	for i := 0; i < len(str); {
+		var class int32
+		if ch := str[i]; ch < utf8.RuneSelf {
+			class = d.asciiClass[ch]
+			i++
+		} else {
+			ch, width := decodeRune(str, i, d.bytes)
+			class = d.class(ch)
+			i += width
+		}
+
+		state = d.table[int(state)*d.stride+int(class)]
+		if state == deadState {
+			return false
+		}
+	}
+	return d.accepting[state]
+}
@@ -17,7 +17,11 @@ func main() {
 	}
 
 	pattern := os.Args[2]
-	nfa := automata.Interp(pattern)
+	nfa, err := automata.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "automata: %v\n", err)
+		os.Exit(2)
+	}
 
 	inputReader := bufio.NewReader(os.Stdin)
 	for {
@@ -1,5 +1,12 @@
 package automata
 
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
 func Match(line string, pattern string) bool {
 	nfa := Interp(pattern)
 	return nfa.Matches(line)
@@ -10,85 +17,415 @@ func MatchDFA(line string, pattern string) bool {
 	return dfa.Matches(line)
 }
 
+const defaultMaxRepeatStates = 10000
+
+// Construction selects how the compiler builds *, + and ?.
+type Construction uint8
+
+const (
+	// ShortcutConstruction adds ε-edges between the ends of the repeated
+	// fragment itself, as Rep, PlusRep and Question do.
+	ShortcutConstruction Construction = iota
+	// ThompsonConstruction wraps every repetition in fresh states, as
+	// RepExplicit, PlusRepExplicit and QuestionExplicit do.
+	ThompsonConstruction
+)
+
+type options struct {
+	flags           Flags
+	maxRepeatStates int
+	construction    Construction
+}
+
+type Option func(*options)
+
+func WithFlags(flags Flags) Option {
+	return func(o *options) {
+		o.flags |= flags
+	}
+}
+
+// WithMaxRepeatStates limits how many NFA states a single counted repetition
+// such as x{2,50} may expand into.
+func WithMaxRepeatStates(n int) Option {
+	return func(o *options) {
+		o.maxRepeatStates = n
+	}
+}
+
+// WithConstruction picks the construction for repetitions. Both accept the
+// same strings and report the same submatches; the shortcut one, the
+// default, makes fewer states.
+func WithConstruction(construction Construction) Option {
+	return func(o *options) {
+		o.construction = construction
+	}
+}
+
+type compiler struct {
+	pattern string
+	opts    options
+}
+
+func Compile(pattern string, opts ...Option) (*NFA, error) {
+	c := compiler{pattern: pattern, opts: options{maxRepeatStates: defaultMaxRepeatStates}}
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+
+	root, names, flags, err := parse(pattern, c.opts.flags)
+	if err != nil {
+		return nil, err
+	}
+	c.opts.flags |= flags
+
+	nfa, err := c.expr(root)
+	if err != nil {
+		return nil, err
+	}
+	nfa.names = names
+	nfa.bytes = c.opts.flags&Bytes != 0
+	nfa = nfa.withProgCache()
+	return &nfa, nil
+}
+
+func MustCompile(pattern string, opts ...Option) *NFA {
+	nfa, err := Compile(pattern, opts...)
+	if err != nil {
+		panic("automata: Compile(" + strconv.Quote(pattern) + "): " + err.Error())
+	}
+	return nfa
+}
+
 func Interp(pattern string) *NFA {
-	nfa := expr(parse(pattern))
-	return &nfa
+	return MustCompile(pattern)
+}
+
+func unexpectedNode(root node) error {
+	return &SyntaxError{Code: ErrInternalError, Offset: root.pos, Token: root.lable}
 }
 
-func expr(root node) NFA {
+func (c *compiler) expr(root node) (NFA, error) {
 	if root.lable == "Expr" {
-		term := term(root.children[0])
+		term, err := c.intersection(root.children[0])
+		if err != nil {
+			return NFA{}, err
+		}
 		if len(root.children) == 3 {
-			return ChoicePair(term, expr(root.children[2]))
+			expr, err := c.expr(root.children[2])
+			if err != nil {
+				return NFA{}, err
+			}
+			return choicePair(term, expr), nil
 		}
-		return term
+		return term, nil
 	} else {
-		panic("expr: " + root.lable)
+		return NFA{}, unexpectedNode(root)
+	}
+}
+
+// intersection compiles both sides of & into DFAs and turns their product
+// back into a fragment.
+func (c *compiler) intersection(root node) (NFA, error) {
+	if root.lable != "Intersect" {
+		return c.term(root)
+	}
+	term, err := c.term(root.children[0])
+	if err != nil {
+		return NFA{}, err
+	}
+	intersection, err := c.intersection(root.children[2])
+	if err != nil {
+		return NFA{}, err
+	}
+	a, err := c.operand(term, root.children[1])
+	if err != nil {
+		return NFA{}, err
 	}
+	b, err := c.operand(intersection, root.children[1])
+	if err != nil {
+		return NFA{}, err
+	}
+	return Intersect(a, b).Minimize().fragment(), nil
 }
 
-func term(root node) NFA {
+func (c *compiler) complement(root node) (NFA, error) {
+	if root.lable == "Complement" {
+		atom, err := c.atom(root.children[0])
+		if err != nil {
+			return NFA{}, err
+		}
+		dfa, err := c.operand(atom, root)
+		if err != nil {
+			return NFA{}, err
+		}
+		return dfa.Complement().Minimize().fragment(), nil
+	} else {
+		return NFA{}, unexpectedNode(root)
+	}
+}
+
+// operand determinizes an operand of & or ~. An assertion in it would look
+// at the ends of the operand instead of at the input around them, so it is
+// an error.
+func (c *compiler) operand(fragment NFA, op node) (*DFA, error) {
+	fragment.bytes = c.opts.flags&Bytes != 0
+	if fragment.getProg().asserts != 0 {
+		return nil, &SyntaxError{Code: ErrAssertInOperand, Offset: op.pos, Token: c.pattern[op.pos : op.pos+1]}
+	}
+	return NewDFA(&fragment), nil
+}
+
+func (c *compiler) term(root node) (NFA, error) {
 	if root.lable == "Term" {
-		factor := factor(root.children[0])
+		if len(root.children) == 0 {
+			return Epsilon(), nil
+		}
+		factor, err := c.factor(root.children[0])
+		if err != nil {
+			return NFA{}, err
+		}
 		if len(root.children) == 2 {
-			return ConcatPair(factor, term(root.children[1]))
+			term, err := c.term(root.children[1])
+			if err != nil {
+				return NFA{}, err
+			}
+			return concatPair(factor, term), nil
 		}
-		return factor
+		return factor, nil
 	} else {
-		panic("term: " + root.lable)
+		return NFA{}, unexpectedNode(root)
 	}
 }
 
-func factor(root node) NFA {
+func (c *compiler) factor(root node) (NFA, error) {
 	if root.lable == "Factor" {
-		atom := atom(root.children[0])
+		atom, err := c.atom(root.children[0])
+		if err != nil {
+			return NFA{}, err
+		}
 		if len(root.children) == 2 {
 			meta := root.children[1].lable
 			if meta == "*" {
-				return Rep(atom)
+				return c.rep(atom), nil
 			}
 			if meta == "+" {
-				return PlusRep(atom)
+				return c.plusRep(atom), nil
 			}
 			if meta == "?" {
-				return Question(atom)
+				return c.question(atom), nil
+			}
+			if meta == "Repeat" {
+				return c.repeat(atom, root.children[1])
 			}
+			return NFA{}, unexpectedNode(root.children[1])
 		}
-		return atom
+		return atom, nil
 	} else {
-		panic("factor: " + root.lable)
+		return NFA{}, unexpectedNode(root)
+	}
+}
+
+func (c *compiler) rep(fragment NFA) NFA {
+	if c.opts.construction == ThompsonConstruction {
+		return repExplicit(fragment)
+	}
+	return rep(fragment)
+}
+
+func (c *compiler) plusRep(fragment NFA) NFA {
+	if c.opts.construction == ThompsonConstruction {
+		return plusRepExplicit(fragment)
+	}
+	return plusRep(fragment)
+}
+
+func (c *compiler) question(fragment NFA) NFA {
+	if c.opts.construction == ThompsonConstruction {
+		return questionExplicit(fragment)
 	}
+	return question(fragment)
 }
 
-func atom(root node) NFA {
+func (c *compiler) atom(root node) (NFA, error) {
 	if root.lable == "Atom" {
 		if len(root.children) == 3 {
-			return expr(root.children[1])
+			return c.expr(root.children[1])
+		}
+		if root.children[0].lable == "Capture" {
+			return c.capture(root.children[0])
+		}
+		if root.children[0].lable == "Class" {
+			return c.class(root.children[0])
+		}
+		if root.children[0].lable == "Assert" {
+			return c.assert(root.children[0])
 		}
-		return char(root.children[0])
+		if root.children[0].lable == "Complement" {
+			return c.complement(root.children[0])
+		}
+		return c.char(root.children[0])
 	} else {
-		panic("atom: " + root.lable)
+		return NFA{}, unexpectedNode(root)
 	}
 }
 
-func char(root node) NFA {
+func (c *compiler) char(root node) (NFA, error) {
 	if root.lable == "Char" {
 		if len(root.children) == 2 {
-			if root.children[1].lable == "d" {
-				return Digit()
+			if isPerlClass(root.children[1].lable) {
+				return CharClass(perlClass(root.children[1].lable, c.opts.flags)), nil
 			}
+			return literal(root.children[1]), nil
+		}
+		return literal(root.children[0]), nil
+	} else {
+		return NFA{}, unexpectedNode(root)
+	}
+}
 
-			if root.children[1].lable == "w" {
-				return Word()
-			}
+// literal matches the rune of a parsed character. It does not go through
+// Char, which takes ε to mean the empty string.
+func literal(ch node) NFA {
+	r, _ := utf8.DecodeRuneInString(ch.lable)
+	return CharRange(r, r)
+}
 
-			if root.children[1].lable == "s" {
-				return Space()
+func (c *compiler) capture(root node) (NFA, error) {
+	if root.lable == "Capture" {
+		index, err := strconv.Atoi(root.children[0].lable)
+		if err != nil {
+			return NFA{}, unexpectedNode(root.children[0])
+		}
+		expr, err := c.expr(root.children[2])
+		if err != nil {
+			return NFA{}, err
+		}
+		return capture(expr, index), nil
+	} else {
+		return NFA{}, unexpectedNode(root)
+	}
+}
+
+func (c *compiler) class(root node) (NFA, error) {
+	if root.lable == "Class" {
+		ranges := []RuneRange{}
+		negated, folded := false, false
+
+		for _, child := range root.children {
+			switch child.lable {
+			case "^":
+				negated = true
+			case "i":
+				folded = true
+			case "Property":
+				property, _ := propertyRanges(child.children[1].lable)
+				property = c.fold(property, folded)
+				if child.children[0].lable == "P" {
+					property = negateRanges(property, universe(c.opts.flags))
+				}
+				ranges = append(ranges, property...)
+			case "Perl":
+				name := child.children[0].lable
+				lower := strings.ToLower(name)
+				class := c.fold(perlClass(lower, c.opts.flags), folded)
+				if lower != name {
+					class = negateRanges(class, universe(c.opts.flags))
+				}
+				ranges = append(ranges, class...)
+			case "Range":
+				lo := []rune(child.children[0].lable)[0]
+				hi := []rune(child.children[1].lable)[0]
+				ranges = append(ranges, c.fold([]RuneRange{{lo, hi}}, folded)...)
+			default:
+				return NFA{}, unexpectedNode(child)
 			}
-			return Char(root.children[1].lable)
 		}
-		return Char(root.children[0].lable)
+
+		if negated {
+			return CharClass(negateRanges(ranges, universe(c.opts.flags))), nil
+		}
+		return CharClass(normalizeRanges(ranges)), nil
 	} else {
-		panic("char: " + root.lable)
+		return NFA{}, unexpectedNode(root)
+	}
+}
+
+// fold adds the case folds of ranges if folded is set. Byte mode only folds
+// ASCII letters.
+func (c *compiler) fold(ranges []RuneRange, folded bool) []RuneRange {
+	if !folded {
+		return ranges
+	}
+	if c.opts.flags&Bytes != 0 {
+		return foldRanges(ranges, unicode.MaxASCII)
+	}
+	return foldRanges(ranges, unicode.MaxRune)
+}
+
+var emptyOps = map[string]EmptyOp{
+	"BeginLine":      EmptyBeginLine,
+	"EndLine":        EmptyEndLine,
+	"BeginText":      EmptyBeginText,
+	"EndText":        EmptyEndText,
+	"WordBoundary":   EmptyWordBoundary,
+	"NoWordBoundary": EmptyNoWordBoundary,
+}
+
+func (c *compiler) assert(root node) (NFA, error) {
+	if root.lable == "Assert" {
+		op, ok := emptyOps[root.children[0].lable]
+		if !ok {
+			return NFA{}, unexpectedNode(root.children[0])
+		}
+		return Assert(op), nil
+	} else {
+		return NFA{}, unexpectedNode(root)
+	}
+}
+
+// repeat expands x{m,n} into m copies of x followed by n-m nested optional
+// copies, x{m} into m copies and x{m,} into m-1 copies followed by x+.
+func (c *compiler) repeat(atom NFA, root node) (NFA, error) {
+	lo, _ := strconv.Atoi(root.children[0].lable)
+	hi, err := strconv.Atoi(root.children[1].lable)
+	unbounded := err != nil
+
+	copies := hi
+	if unbounded {
+		copies = max(lo, 1)
+	}
+	if copies > c.opts.maxRepeatStates || copies*len(atom.states()) > c.opts.maxRepeatStates {
+		end := root.pos + strings.IndexByte(c.pattern[root.pos:], '}') + 1
+		return NFA{}, &SyntaxError{Code: ErrRepeatTooLarge, Offset: root.pos, Token: c.pattern[root.pos:end]}
+	}
+
+	if unbounded && lo == 0 {
+		return c.rep(atom), nil
+	}
+	if copies == 0 {
+		return Epsilon(), nil
+	}
+
+	fragments := []NFA{atom}
+	for len(fragments) < copies {
+		fragments = append(fragments, atom.Clone())
+	}
+
+	if unbounded {
+		fragments[lo-1] = c.plusRep(fragments[lo-1])
+		return concat(fragments[0], fragments[1:]), nil
+	}
+
+	if hi == lo {
+		return concat(fragments[0], fragments[1:]), nil
+	}
+	optional := c.question(fragments[hi-1])
+	for i := hi - 2; i >= lo; i-- {
+		optional = c.question(concatPair(fragments[i], optional))
+	}
+	if lo == 0 {
+		return optional, nil
 	}
+	return concat(fragments[0], append(fragments[1:lo], optional)), nil
 }
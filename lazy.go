@@ -0,0 +1,142 @@
+package automata
+
+import "sync"
+
+// thrashFactor sets how many bytes of input a lazy DFA must get through per
+// cached state between two cache flushes, over any number of calls, before
+// flushing is considered thrashing.
+const thrashFactor = 10
+
+// WithLazyCache makes the DFA build its subset states only as Matches needs
+// them, keeping at most maxStates of them. A full cache is flushed and
+// refilled; when that happens too often for the input consumed, Matches
+// gives up on the cache and finishes with the NFA simulation. The cache is
+// locked while Matches runs, so goroutines sharing the DFA take turns. The
+// other methods of a lazy DFA still build the complete transition table.
+func WithLazyCache(maxStates int) DFAOption {
+	return func(dfa *DFA) {
+		dfa.lazy = &lazyDFA{
+			prog:      dfa.nfa.getProg(),
+			alphabet:  dfa.GetAlphabet(),
+			maxStates: max(maxStates, 1),
+			cache:     make(map[string]*lazyState),
+		}
+	}
+}
+
+// lazyState is a cached subset state and its successors by alphabet symbol,
+// filled in on first use.
+type lazyState struct {
+	dfaState
+	accept bool
+	next   []*lazyState
+}
+
+type lazyDFA struct {
+	// mu guards the cache and the counters below it.
+	mu        sync.Mutex
+	prog      *prog
+	alphabet  []RuneRange
+	maxStates int
+	cache     map[string]*lazyState
+	// sinceFlush counts the bytes of input read since the cache was last
+	// flushed, by the cache or by the NFA simulation in its place.
+	sinceFlush int
+
+	flushes   int
+	fallbacks int
+}
+
+var deadLazyState = &lazyState{}
+
+// state returns the cached state for s, adding it if it is new. It reports
+// false if the cache is full.
+func (l *lazyDFA) state(s dfaState) (*lazyState, bool) {
+	if s.dead() {
+		return deadLazyState, true
+	}
+
+	key := s.label()
+	if st, ok := l.cache[key]; ok {
+		return st, true
+	}
+	if len(l.cache) >= l.maxStates {
+		return nil, false
+	}
+
+	st := lazyState{dfaState: s, accept: l.prog.dfaAccepts(s), next: make([]*lazyState, len(l.alphabet))}
+	l.cache[key] = &st
+	return &st, true
+}
+
+// step returns the successor of st on the alphabet symbol at index c. If it
+// is not cached and does not fit in the cache, step reports false and returns
+// the successor itself instead.
+func (l *lazyDFA) step(st *lazyState, c int) (*lazyState, dfaState, bool) {
+	if next := st.next[c]; next != nil {
+		return next, dfaState{}, true
+	}
+
+	s := l.prog.dfaNext(st.dfaState, l.alphabet[c].Lo)
+	next, ok := l.state(s)
+	if !ok {
+		return nil, s, false
+	}
+	st.next[c] = next
+	return next, dfaState{}, true
+}
+
+func (l *lazyDFA) flush() {
+	l.cache = make(map[string]*lazyState)
+	l.sinceFlush = 0
+	l.flushes++
+}
+
+// thrashing reports whether the cache filled up again too soon after the
+// last flush. A cache that was never flushed is not thrashing yet.
+func (l *lazyDFA) thrashing() bool {
+	return l.flushes > 0 && l.sinceFlush < thrashFactor*l.maxStates
+}
+
+func lazyMatches[T input](l *lazyDFA, str T) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := l.prog.dfaStart()
+	st, ok := l.state(start)
+	if !ok {
+		l.flush()
+		st, _ = l.state(start)
+	}
+
+	prev := rune(-1)
+	for i := 0; i < len(str); {
+		ch, width := decodeRune(str, i, l.prog.bytes)
+		c, ok := findRange(l.alphabet, ch)
+		if !ok {
+			return false
+		}
+
+		next, s, ok := l.step(st, c)
+		if !ok {
+			if l.thrashing() {
+				l.fallbacks++
+				l.sinceFlush += len(str) - i
+				return simulate(l.prog, st.states, prev, str[i:])
+			}
+
+			// refill the cache starting from the successor
+			l.flush()
+			next, _ = l.state(s)
+		}
+
+		if next == deadLazyState {
+			return false
+		}
+		st = next
+		prev = ch
+		i += width
+		l.sinceFlush += width
+	}
+	return st.accept
+}
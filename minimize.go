@@ -0,0 +1,249 @@
+package automata
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Minimize returns the equivalent DFA with the fewest states, computed with
+// Hopcroft's partition refinement. Like the subset construction it leaves out
+// the dead state, so missing transitions still mean rejection.
+func (dfa *DFA) Minimize() *DFA {
+	table := dfa.GetTransitionTable()
+	alphabet := dfa.GetAlphabet()
+	acceptingStateNums := dfa.GetAcceptingStateNums()
+
+	labels := slices.Sorted(maps.Keys(table))
+	index := make(map[string]int, len(labels))
+	for i, label := range labels {
+		index[label] = i
+	}
+
+	// complete the DFA with an explicit dead state so that every state has a
+	// successor on every symbol
+	dead := len(labels)
+	delta := make([][]int, len(labels)+1)
+	for q := range delta {
+		delta[q] = make([]int, len(alphabet))
+		for c, symbol := range alphabet {
+			delta[q][c] = dead
+			if q == dead {
+				continue
+			}
+			if next, ok := table[labels[q]][symbol]; ok {
+				delta[q][c] = index[next]
+			}
+		}
+	}
+
+	inverse := make([][][]int, len(alphabet))
+	for c := range alphabet {
+		inverse[c] = make([][]int, len(delta))
+		for q := range delta {
+			inverse[c][delta[q][c]] = append(inverse[c][delta[q][c]], q)
+		}
+	}
+
+	// states are told apart first by whether they accept, at the end of the
+	// input and right before the last rune read
+	initial := make([][]int, 4)
+	for q := range delta {
+		kind := 0
+		if q != dead && acceptingStateNums[labels[q]] {
+			kind |= 1
+		}
+		if q != dead && dfa.matchedStateNums[labels[q]] {
+			kind |= 2
+		}
+		initial[kind] = append(initial[kind], q)
+	}
+
+	blocks := [][]int{}
+	blockOf := make([]int, len(delta))
+	for _, block := range initial {
+		if len(block) == 0 {
+			continue
+		}
+		for _, q := range block {
+			blockOf[q] = len(blocks)
+		}
+		blocks = append(blocks, block)
+	}
+
+	work := []int{}
+	inWork := make(map[int]bool)
+	for b := range blocks {
+		work = append(work, b)
+		inWork[b] = true
+	}
+
+	for len(work) > 0 {
+		splitter := slices.Clone(blocks[work[len(work)-1]])
+		inWork[work[len(work)-1]] = false
+		work = work[:len(work)-1]
+
+		for c := range alphabet {
+			// the states of each block that move into the splitter on c
+			predecessors := make(map[int][]int)
+			for _, q := range splitter {
+				for _, p := range inverse[c][q] {
+					predecessors[blockOf[p]] = append(predecessors[blockOf[p]], p)
+				}
+			}
+
+			for b, inside := range predecessors {
+				if len(inside) == len(blocks[b]) {
+					continue
+				}
+
+				isInside := make(map[int]bool, len(inside))
+				for _, q := range inside {
+					isInside[q] = true
+				}
+				outside := []int{}
+				for _, q := range blocks[b] {
+					if !isInside[q] {
+						outside = append(outside, q)
+					}
+				}
+
+				split := len(blocks)
+				blocks[b] = inside
+				blocks = append(blocks, outside)
+				for _, q := range outside {
+					blockOf[q] = split
+				}
+
+				if inWork[b] || len(outside) <= len(inside) {
+					work = append(work, split)
+					inWork[split] = true
+				} else {
+					work = append(work, b)
+					inWork[b] = true
+				}
+			}
+		}
+	}
+
+	// number the blocks breadth-first from the start state, dropping the
+	// block of the dead state
+	deadBlock := blockOf[dead]
+	start := blockOf[index[dfa.startState]]
+	numbers := map[int]string{start: "1"}
+	minimized := DFA{
+		alphabet:           alphabet,
+		startState:         "1",
+		acceptingStateNums: make(map[string]bool),
+		transTable:         make(map[string]map[RuneRange]string),
+		matchOnly:          dfa.matchOnly,
+		bytes:              dfa.bytes,
+	}
+
+	queue := []int{start}
+	if dfa.startStates != nil {
+		minimized.matchedStateNums = make(map[string]bool)
+		minimized.startStates = make(map[EmptyOp]string)
+		for _, prev := range lookbehindRunes {
+			queue = append(queue, blockOf[index[dfa.startStates[lookbehindContext(prev)]]])
+		}
+	}
+	for ; len(queue) > 0; queue = queue[1:] {
+		b := queue[0]
+		if _, ok := numbers[b]; !ok {
+			numbers[b] = strconv.Itoa(len(numbers) + 1)
+		} else if minimized.transTable[numbers[b]] != nil {
+			continue
+		}
+		q := blocks[b][0]
+		row := make(map[RuneRange]string)
+		for c, symbol := range alphabet {
+			next := blockOf[delta[q][c]]
+			if next == deadBlock {
+				continue
+			}
+			if _, ok := numbers[next]; !ok {
+				numbers[next] = strconv.Itoa(len(numbers) + 1)
+				queue = append(queue, next)
+			}
+			row[symbol] = numbers[next]
+		}
+		minimized.transTable[numbers[b]] = row
+		if q != dead && acceptingStateNums[labels[q]] {
+			minimized.acceptingStateNums[numbers[b]] = true
+		}
+		if q != dead && dfa.matchedStateNums[labels[q]] {
+			minimized.matchedStateNums[numbers[b]] = true
+		}
+	}
+	for context, label := range dfa.startStates {
+		minimized.startStates[context] = numbers[blockOf[index[label]]]
+	}
+	return &minimized
+}
+
+// MinimizeBrzozowski minimizes by determinizing the reversed automaton twice.
+// It is much slower than Minimize but independent of it, which makes it a
+// useful cross-check.
+func (dfa *DFA) MinimizeBrzozowski() *DFA {
+	return dfa.reverseDeterminize().reverseDeterminize()
+}
+
+// reverseDeterminize runs the subset construction on the reversed DFA, whose
+// start state is the set of accepting states and whose only accepting state
+// is the original start state.
+func (dfa *DFA) reverseDeterminize() *DFA {
+	table := dfa.GetTransitionTable()
+	alphabet := dfa.GetAlphabet()
+
+	predecessors := make(map[string]map[RuneRange][]string)
+	for from, row := range table {
+		for symbol, to := range row {
+			if predecessors[to] == nil {
+				predecessors[to] = make(map[RuneRange][]string)
+			}
+			predecessors[to][symbol] = append(predecessors[to][symbol], from)
+		}
+	}
+
+	reversed := DFA{
+		alphabet:           alphabet,
+		startState:         "1",
+		acceptingStateNums: make(map[string]bool),
+		transTable:         make(map[string]map[RuneRange]string),
+		matchOnly:          dfa.hasAssertions(),
+		bytes:              dfa.bytes,
+	}
+
+	start := slices.Sorted(maps.Keys(dfa.GetAcceptingStateNums()))
+	numbers := map[string]string{strings.Join(start, ","): "1"}
+	for queue := [][]string{start}; len(queue) > 0; queue = queue[1:] {
+		subset := queue[0]
+		number := numbers[strings.Join(subset, ",")]
+		row := make(map[RuneRange]string)
+		for _, symbol := range alphabet {
+			next := []string{}
+			for _, label := range subset {
+				next = append(next, predecessors[label][symbol]...)
+			}
+			if len(next) == 0 {
+				continue
+			}
+			slices.Sort(next)
+			next = slices.Compact(next)
+
+			key := strings.Join(next, ",")
+			if _, ok := numbers[key]; !ok {
+				numbers[key] = strconv.Itoa(len(numbers) + 1)
+				queue = append(queue, next)
+			}
+			row[symbol] = numbers[key]
+		}
+		reversed.transTable[number] = row
+		if slices.Contains(subset, dfa.startState) {
+			reversed.acceptingStateNums[number] = true
+		}
+	}
+	return &reversed
+}
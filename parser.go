@@ -1,103 +1,785 @@
 package automata
 
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Flags uint16
+
+const (
+	DotNL          Flags = 1 << iota // allow . to match newline
+	MultiLine                        // allow ^ and $ to match at the start and end of lines
+	UnicodeClasses                   // let \d, \s and \w follow the Unicode categories
+	Bytes                            // match bytes instead of UTF-8 encoded runes
+	FoldCase                         // match letters regardless of case
+	Extended                         // allow & for intersection and ~ for complement
+)
+
+// flagLetters are the flags that (?flags) and (?flags:re) can set; u is set
+// by default and can only be cleared for the whole pattern.
+var flagLetters = map[rune]Flags{
+	'i': FoldCase,
+	'm': MultiLine,
+	's': DotNL,
+	'u': Bytes,
+}
+
+type ErrorCode string
+
+const (
+	ErrAssertInOperand           ErrorCode = "assertion in an operand of & or ~"
+	ErrDuplicateName             ErrorCode = "duplicate capture group name"
+	ErrInternalError             ErrorCode = "unexpected parse tree node"
+	ErrInvalidCharRange          ErrorCode = "invalid character class range"
+	ErrInvalidEscape             ErrorCode = "invalid escape sequence"
+	ErrInvalidNamedCapture       ErrorCode = "invalid named capture"
+	ErrInvalidPerlOp             ErrorCode = "invalid or unsupported Perl syntax"
+	ErrInvalidRepeatOp           ErrorCode = "invalid nested repetition operator"
+	ErrInvalidRepeatSize         ErrorCode = "invalid repeat count"
+	ErrInvalidUTF8               ErrorCode = "invalid UTF-8"
+	ErrMissingBracket            ErrorCode = "missing closing ]"
+	ErrMissingComplementArgument ErrorCode = "missing argument to complement operator"
+	ErrMissingParen              ErrorCode = "missing closing )"
+	ErrMissingRepeatArgument     ErrorCode = "missing argument to repetition operator"
+	ErrRepeatTooLarge            ErrorCode = "repetition exceeds the state limit"
+	ErrTrailingBackslash         ErrorCode = "trailing backslash at end of expression"
+	ErrUnexpectedParen           ErrorCode = "unexpected )"
+)
+
+func (e ErrorCode) String() string {
+	return string(e)
+}
+
+// SyntaxError reports a malformed pattern. Offset is the byte offset of Token
+// in the pattern.
+type SyntaxError struct {
+	Code   ErrorCode
+	Offset int
+	Token  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("error parsing pattern at offset %d: %s: `%s`", e.Offset, e.Code, e.Token)
+}
+
 type node struct {
 	lable    string
 	children []node
+	pos      int
+}
+
+func newNode(ch rune, pos int) node {
+	return node{string(ch), []node{}, pos}
 }
 
-func newNode(ch byte) node {
-	return node{string(ch), []node{}}
+func rangeNode(lo, hi rune, pos int) node {
+	return node{"Range", []node{{string(lo), []node{}, pos}, {string(hi), []node{}, pos}}, pos}
 }
 
 type parser struct {
 	pattern string
 	pos     int
+	flags   Flags
+	names   []string
+}
+
+// parse also returns the capture group names, indexed by group number; group
+// 0 is the whole match and unnamed groups have empty names, and the flags of
+// the whole pattern, which a leading (?-u) changes.
+func parse(pattern string, flags Flags) (node, []string, Flags, error) {
+	p := parser{pattern: pattern, flags: flags, names: []string{""}}
+	for i, ch := range pattern {
+		if ch == utf8.RuneError {
+			if _, width := utf8.DecodeRuneInString(pattern[i:]); width == 1 {
+				return node{}, nil, 0, p.errorf(ErrInvalidUTF8, i, i+1)
+			}
+		}
+	}
+
+	if strings.HasPrefix(pattern, "(?-u)") {
+		p.flags |= Bytes
+		p.pos += len("(?-u)")
+	}
+
+	expr, err := p.expr()
+	if err != nil {
+		return node{}, nil, 0, err
+	}
+
+	// expr only stops early on a ')' that no group opened
+	if p.hasMore() {
+		return node{}, nil, 0, p.errorf(ErrUnexpectedParen, p.pos, p.pos+1)
+	}
+	return expr, p.names, p.flags & Bytes, nil
 }
 
-func parse(pattern string) node {
-	p := parser{pattern: pattern}
-	return p.expr()
+func (p parser) errorf(code ErrorCode, start, end int) *SyntaxError {
+	return &SyntaxError{Code: code, Offset: start, Token: p.pattern[start:end]}
 }
 
 func (p parser) hasMore() bool {
 	return p.pos < len(p.pattern)
 }
 
-func (p parser) peek() byte {
-	return p.pattern[p.pos]
+func (p parser) peek() rune {
+	ch, _ := utf8.DecodeRuneInString(p.pattern[p.pos:])
+	return ch
 }
-func (p *parser) next() byte {
-	ch := p.peek()
-	p.match(ch)
+func (p *parser) next() rune {
+	ch, width := utf8.DecodeRuneInString(p.pattern[p.pos:])
+	p.pos += width
 	return ch
 }
 
-func (p *parser) match(ch byte) {
-	if p.peek() != ch {
-		panic("Unexpected symbol " + string(ch))
+func (p *parser) expr() (node, error) {
+	pos := p.pos
+	term, err := p.intersection()
+	if err != nil {
+		return node{}, err
+	}
+
+	if p.hasMore() && p.peek() == '|' {
+		bar := newNode(p.next(), p.pos-len("|"))
+		expr, err := p.expr()
+		if err != nil {
+			return node{}, err
+		}
+		return node{"Expr", []node{term, bar, expr}, pos}, nil
 	}
 
-	p.pos++
+	return node{"Expr", []node{term}, pos}, nil
 }
 
-func (p *parser) expr() node {
-	term := p.term()
-	if p.hasMore() && p.peek() == '|' {
-		p.match('|')
-		expr := p.expr()
-		return node{"Expr", []node{term, newNode('|'), expr}}
+// intersection parses term&term&... into an Intersect node holding the first
+// term, the & and the intersection of the rest. & binds more loosely than
+// concatenation and more tightly than |, and is only an operator in Extended
+// mode; otherwise this is just a term. The operands are compiled into DFAs,
+// which cannot record submatches, so their groups do not capture.
+func (p *parser) intersection() (node, error) {
+	pos := p.pos
+	groups := len(p.names)
+	term, err := p.term()
+	if err != nil {
+		return node{}, err
+	}
+
+	if p.flags&Extended != 0 && p.hasMore() && p.peek() == '&' {
+		p.names = p.names[:groups]
+		amp := newNode(p.next(), p.pos-len("&"))
+		intersection, err := p.intersection()
+		if err != nil {
+			return node{}, err
+		}
+		p.names = p.names[:groups]
+		return node{"Intersect", []node{uncapture(term), amp, uncapture(intersection)}, pos}, nil
 	}
 
-	return node{"Expr", []node{term}}
+	return term, nil
 }
 
-func (p *parser) term() node {
-	factor := p.factor()
+// endOfTerm reports whether the current term ends here.
+func (p parser) endOfTerm() bool {
+	if !p.hasMore() {
+		return true
+	}
+	ch := p.peek()
+	return ch == ')' || ch == '|' || p.flags&Extended != 0 && ch == '&'
+}
+
+func (p *parser) term() (node, error) {
+	pos := p.pos
+	if p.endOfTerm() {
+		return node{"Term", []node{}, pos}, nil
+	}
 
-	if p.hasMore() && p.peek() != ')' && p.peek() != '|' {
-		term := p.term()
-		return node{"Term", []node{factor, term}}
+	factor, err := p.factor()
+	if err != nil {
+		return node{}, err
 	}
 
-	return node{"Term", []node{factor}}
+	if !p.endOfTerm() {
+		term, err := p.term()
+		if err != nil {
+			return node{}, err
+		}
+		return node{"Term", []node{factor, term}, pos}, nil
+	}
+
+	return node{"Term", []node{factor}, pos}, nil
 }
 
-func (p *parser) factor() node {
-	atom := p.atom()
+func (p *parser) factor() (node, error) {
+	pos := p.pos
+	atom, err := p.atom()
+	if err != nil {
+		return node{}, err
+	}
 
+	var meta node
 	if p.hasMore() && isMetaChar(p.peek()) {
-		meta := p.next()
-		return node{"Factor", []node{atom, newNode(meta)}}
+		meta = newNode(p.next(), p.pos-len("*"))
+	} else if repeat, ok, err := p.repeat(); err != nil {
+		return node{}, err
+	} else if ok {
+		meta = repeat
+	} else {
+		return node{"Factor", []node{atom}, pos}, nil
 	}
 
-	return node{"Factor", []node{atom}}
+	if end, ok := p.repeatOpAhead(); ok {
+		return node{}, p.errorf(ErrInvalidRepeatOp, meta.pos, end)
+	}
+	return node{"Factor", []node{atom, meta}, pos}, nil
 }
 
-func (p *parser) atom() node {
-	if p.peek() == '(' {
-		p.match('(')
-		expr := p.expr()
-		p.match(')')
-		return node{"Atom", []node{newNode('('), expr, newNode(')')}}
+// repeat parses a counted repetition {m}, {m,} or {m,n} into a Repeat node
+// whose children are the bounds; an unbounded maximum is empty. Anything else
+// starting with '{' is not a repetition and leaves the parser untouched, so
+// the brace is read as a literal.
+func (p *parser) repeat() (node, bool, error) {
+	pos := p.pos
+	if !p.hasMore() || p.peek() != '{' {
+		return node{}, false, nil
+	}
+	p.next()
+
+	lower, ok := p.repeatCount()
+	if !ok {
+		p.pos = pos
+		return node{}, false, nil
+	}
+	upper := lower
+	if p.hasMore() && p.peek() == ',' {
+		p.next()
+		upper = node{"", []node{}, p.pos}
+		if p.hasMore() && p.peek() != '}' {
+			if upper, ok = p.repeatCount(); !ok {
+				p.pos = pos
+				return node{}, false, nil
+			}
+		}
+	}
+	if !p.hasMore() || p.peek() != '}' {
+		p.pos = pos
+		return node{}, false, nil
 	}
+	p.next()
 
-	ch := p.char()
-	return node{"Atom", []node{ch}}
+	lo, errLo := strconv.Atoi(lower.lable)
+	hi, errHi := strconv.Atoi(upper.lable)
+	if errLo != nil || (upper.lable != "" && (errHi != nil || hi < lo)) {
+		return node{}, false, p.errorf(ErrInvalidRepeatSize, pos, p.pos)
+	}
+	return node{"Repeat", []node{lower, upper}, pos}, true, nil
 }
 
-func (p *parser) char() node {
+func (p *parser) repeatCount() (node, bool) {
+	start := p.pos
+	for p.hasMore() && '0' <= p.peek() && p.peek() <= '9' {
+		p.next()
+	}
+	return node{p.pattern[start:p.pos], []node{}, start}, p.pos > start
+}
+
+// repeatOpAhead reports whether a repetition operator starts at the current
+// position and where it ends, without consuming it.
+func (p parser) repeatOpAhead() (int, bool) {
+	if !p.hasMore() {
+		return 0, false
+	}
 	if isMetaChar(p.peek()) {
-		panic("Unexpected meta char " + string(p.peek()))
+		return p.pos + 1, true
+	}
+	if _, ok, err := p.repeat(); ok || err != nil {
+		return p.pos, true
+	}
+	return 0, false
+}
+
+func (p *parser) atom() (node, error) {
+	pos := p.pos
+	if p.peek() == '(' {
+		return p.group()
+	}
+
+	if p.peek() == '.' {
+		return node{"Atom", []node{p.dot()}, pos}, nil
+	}
+
+	if p.flags&Extended != 0 && p.peek() == '~' {
+		return p.complement()
+	}
+
+	if assert, ok := p.assert(); ok {
+		return node{"Atom", []node{assert}, pos}, nil
+	}
+
+	if p.peek() == '[' {
+		class, err := p.class()
+		if err != nil {
+			return node{}, err
+		}
+		return node{"Atom", []node{class}, pos}, nil
+	}
+
+	if property, ok, err := p.property(); err != nil {
+		return node{}, err
+	} else if ok {
+		return node{"Atom", []node{{"Class", p.classFlags(property), pos}}, pos}, nil
+	}
+
+	if p.flags&Bytes != 0 && p.peek() >= utf8.RuneSelf {
+		return byteSequence(p.next(), pos), nil
+	}
+
+	ch, err := p.char()
+	if err != nil {
+		return node{}, err
+	}
+	if p.flags&FoldCase != 0 {
+		return node{"Atom", []node{foldedChar(ch)}, pos}, nil
+	}
+	return node{"Atom", []node{ch}, pos}, nil
+}
+
+// complement parses ~atom into a Complement node. Like the repetitions in
+// factor, it applies to a single atom, and binds more tightly than them, so
+// ~a* is (~a)*. As with &, groups in the operand do not capture.
+func (p *parser) complement() (node, error) {
+	pos := p.pos
+	p.next()
+	if p.endOfTerm() {
+		return node{}, p.errorf(ErrMissingComplementArgument, pos, p.pos)
+	}
+	groups := len(p.names)
+	atom, err := p.atom()
+	if err != nil {
+		return node{}, err
+	}
+	p.names = p.names[:groups]
+	return node{"Atom", []node{{"Complement", []node{uncapture(atom)}, pos}}, pos}, nil
+}
+
+// uncapture turns the capture groups in root into groups that only group.
+func uncapture(root node) node {
+	if root.lable == "Atom" && len(root.children) == 1 && root.children[0].lable == "Capture" {
+		capture := root.children[0]
+		return node{"Atom", []node{newNode('(', capture.pos), uncapture(capture.children[2]), newNode(')', capture.pos)}, root.pos}
+	}
+	children := make([]node, len(root.children))
+	for i, child := range root.children {
+		children[i] = uncapture(child)
+	}
+	return node{root.lable, children, root.pos}
+}
+
+func (p *parser) char() (node, error) {
+	pos := p.pos
+	if end, ok := p.repeatOpAhead(); ok {
+		return node{}, p.errorf(ErrMissingRepeatArgument, pos, end)
 	}
 
 	if p.peek() == '\\' {
-		p.match('\\')
-		return node{"Char", []node{newNode('\\'), newNode(p.next())}}
+		backslash := newNode(p.next(), pos)
+		if !p.hasMore() {
+			return node{}, p.errorf(ErrTrailingBackslash, pos, pos+1)
+		}
+		escaped, value, err := p.escape(pos)
+		if err != nil {
+			return node{}, err
+		}
+		if value {
+			return node{"Char", []node{escaped}, pos}, nil
+		}
+		return node{"Char", []node{backslash, escaped}, pos}, nil
+	}
+
+	return node{"Char", []node{newNode(p.next(), pos)}, pos}, nil
+}
+
+// escapeChars are the single letter escapes of control characters.
+var escapeChars = map[rune]rune{
+	'a': '\a',
+	'f': '\f',
+	'n': '\n',
+	'r': '\r',
+	't': '\t',
+	'v': '\v',
+}
+
+// escape parses what follows the backslash at start. It reports whether the
+// escape spelled out a value, as \n, \x{HHHH} or \123 do with the rune, or
+// the byte in byte mode, of that value. Perl classes and punctuation are
+// returned as is, and any other letter or digit is an error.
+func (p *parser) escape(start int) (node, bool, error) {
+	pos := p.pos
+	ch := p.next()
+	if value, ok := escapeChars[ch]; ok {
+		return newNode(value, pos), true, nil
+	}
+
+	var value uint64
+	var err error
+	switch {
+	case ch == 'x' && p.hasMore() && p.peek() == '{':
+		end := strings.IndexByte(p.pattern[p.pos:], '}')
+		if end < 0 {
+			return node{}, false, p.errorf(ErrInvalidEscape, start, len(p.pattern))
+		}
+		end += p.pos
+		value, err = strconv.ParseUint(p.pattern[p.pos+1:end], 16, 32)
+		p.pos = end + 1
+	case ch == 'x' || ch == 'u':
+		digits := 2
+		if ch == 'u' {
+			digits = 4
+		}
+		end := min(p.pos+digits, len(p.pattern))
+		value, err = strconv.ParseUint(p.pattern[p.pos:end], 16, 32)
+		if err == nil && end-p.pos < digits {
+			err = strconv.ErrSyntax
+		}
+		p.pos = end
+	case '0' <= ch && ch <= '7':
+		// \0 may stand alone, other octal escapes need a second digit so as not
+		// to look like a backreference
+		end := p.pos
+		for end < len(p.pattern) && end < pos+3 && '0' <= p.pattern[end] && p.pattern[end] <= '7' {
+			end++
+		}
+		if ch != '0' && end == p.pos {
+			return node{}, false, p.errorf(ErrInvalidEscape, start, end)
+		}
+		value, err = strconv.ParseUint(p.pattern[pos:end], 8, 32)
+		p.pos = end
+	case isPerlClass(string(ch)) || !unicode.IsLetter(ch) && !unicode.IsDigit(ch):
+		return newNode(ch, pos), false, nil
+	default:
+		return node{}, false, p.errorf(ErrInvalidEscape, start, p.pos)
+	}
+
+	limit := uint64(unicode.MaxRune)
+	if p.flags&Bytes != 0 {
+		limit = 0xff
+	}
+	if err != nil || value > limit || p.flags&Bytes == 0 && !utf8.ValidRune(rune(value)) {
+		return node{}, false, p.errorf(ErrInvalidEscape, start, p.pos)
+	}
+	return newNode(rune(value), pos), true, nil
+}
+
+// classFlags starts the children of a Class node, with an i node first if
+// the class folds case.
+func (p parser) classFlags(children ...node) []node {
+	if p.flags&FoldCase != 0 {
+		return append([]node{{"i", []node{}, p.pos}}, children...)
+	}
+	return append([]node{}, children...)
+}
+
+// foldedChar turns a Char node into a Class node that folds case.
+func foldedChar(char node) node {
+	member := char.children[len(char.children)-1]
+	fold := node{"i", []node{}, char.pos}
+	if len(char.children) == 2 && isPerlClass(member.lable) {
+		return node{"Class", []node{fold, {"Perl", []node{member}, char.pos}}, char.pos}
+	}
+	return node{"Class", []node{fold, {"Range", []node{member, member}, char.pos}}, char.pos}
+}
+
+// byteSequence spells out the UTF-8 encoding of a literal as a group of byte
+// literals, which is what the literal stands for in byte mode.
+func byteSequence(ch rune, pos int) node {
+	encoded := []byte(string(ch))
+	term := node{"Term", []node{}, pos}
+	for i := len(encoded) - 1; i >= 0; i-- {
+		char := node{"Char", []node{newNode(rune(encoded[i]), pos)}, pos}
+		factor := node{"Factor", []node{{"Atom", []node{char}, pos}}, pos}
+		if len(term.children) == 0 {
+			term = node{"Term", []node{factor}, pos}
+		} else {
+			term = node{"Term", []node{factor, term}, pos}
+		}
+	}
+	return node{"Atom", []node{newNode('(', pos), {"Expr", []node{term}, pos}, newNode(')', pos)}, pos}
+}
+
+// group parses (re) and (?P<name>re) or (?<name>re) into a Capture node
+// holding the group number, its name and the expression, and (?:re) into an
+// Atom that only groups.
+func (p *parser) group() (node, error) {
+	pos := p.pos
+	open := newNode(p.next(), pos)
+
+	capture, name := true, ""
+	flags := p.flags
+	if p.hasMore() && p.peek() == '?' {
+		rest := p.pattern[p.pos:]
+		switch {
+		case strings.HasPrefix(rest, "?:"):
+			p.pos += len("?:")
+			capture = false
+		case strings.HasPrefix(rest, "?P<") || strings.HasPrefix(rest, "?<"):
+			p.pos += strings.IndexByte(rest, '<') + 1
+			end := strings.IndexByte(p.pattern[p.pos:], '>')
+			if end < 0 {
+				return node{}, p.errorf(ErrInvalidNamedCapture, pos, len(p.pattern))
+			}
+			name = p.pattern[p.pos : p.pos+end]
+			p.pos += end + 1
+			if !isValidCaptureName(name) {
+				return node{}, p.errorf(ErrInvalidNamedCapture, pos, p.pos)
+			}
+			if slices.Contains(p.names, name) {
+				return node{}, p.errorf(ErrDuplicateName, pos, p.pos)
+			}
+		default:
+			closed, err := p.setFlags(pos)
+			if err != nil {
+				return node{}, err
+			}
+			if closed {
+				// (?flags) holds until the end of the enclosing group
+				empty := node{"Expr", []node{{"Term", []node{}, pos}}, pos}
+				return node{"Atom", []node{open, empty, newNode(')', p.pos-len(")"))}, pos}, nil
+			}
+			capture = false
+		}
+	}
+
+	index := len(p.names)
+	if capture {
+		p.names = append(p.names, name)
+	}
+
+	expr, err := p.expr()
+	if err != nil {
+		return node{}, err
+	}
+	if !p.hasMore() || p.peek() != ')' {
+		return node{}, p.errorf(ErrMissingParen, pos, pos+1)
+	}
+	closing := newNode(p.next(), p.pos-len(")"))
+	p.flags = flags
+
+	if capture {
+		number := node{strconv.Itoa(index), []node{}, pos}
+		label := node{name, []node{}, pos}
+		return node{"Atom", []node{{"Capture", []node{number, label, expr}, pos}}, pos}, nil
+	}
+	return node{"Atom", []node{open, expr, closing}, pos}, nil
+}
+
+// setFlags parses the flags of (?flags) or (?flags:re), such as (?m) or
+// (?s-m:re), after the parenthesis at start. It reports whether the group
+// ended with the flags.
+func (p *parser) setFlags(start int) (bool, error) {
+	p.next()
+	negated, empty := false, true
+	for p.hasMore() {
+		ch := p.next()
+		switch {
+		case ch == ')' || ch == ':':
+			if empty {
+				break
+			}
+			return ch == ')', nil
+		case ch == '-' && !negated:
+			negated, empty = true, true
+			continue
+		case flagLetters[ch] != 0:
+			flag := flagLetters[ch]
+			if ch == 'u' {
+				// the leading (?-u) is handled by parse, and the whole
+				// automaton either decodes UTF-8 or it does not
+				if negated != (p.flags&flag != 0) {
+					break
+				}
+			} else if negated {
+				p.flags &^= flag
+			} else {
+				p.flags |= flag
+			}
+			empty = false
+			continue
+		}
+		break
+	}
+	return false, p.errorf(ErrInvalidPerlOp, start, p.pos)
+}
+
+// assert parses the anchors ^, $, \A and \z and the word boundaries \b and
+// \B into an Assert node naming the position it requires.
+func (p *parser) assert() (node, bool) {
+	pos := p.pos
+	var name string
+	switch rest := p.pattern[p.pos:]; {
+	case rest[0] == '^' && p.flags&MultiLine != 0:
+		name = "BeginLine"
+	case rest[0] == '$' && p.flags&MultiLine != 0:
+		name = "EndLine"
+	case rest[0] == '^' || strings.HasPrefix(rest, `\A`):
+		name = "BeginText"
+	case rest[0] == '$' || strings.HasPrefix(rest, `\z`):
+		name = "EndText"
+	case strings.HasPrefix(rest, `\b`):
+		name = "WordBoundary"
+	case strings.HasPrefix(rest, `\B`):
+		name = "NoWordBoundary"
+	default:
+		return node{}, false
+	}
+	if p.next() == '\\' {
+		p.next()
 	}
+	return node{"Assert", []node{{name, []node{}, pos}}, pos}, true
+}
 
-	return node{"Char", []node{newNode(p.next())}}
+// property parses \pN or \p{Name}, and their negations \PN, \P{Name} and
+// \p{^Name}, into a Property node holding p or P and the name of a Unicode
+// category or script.
+func (p *parser) property() (node, bool, error) {
+	pos := p.pos
+	rest := p.pattern[p.pos:]
+	if !strings.HasPrefix(rest, `\p`) && !strings.HasPrefix(rest, `\P`) {
+		return node{}, false, nil
+	}
+	if p.flags&Bytes != 0 {
+		return node{}, false, p.errorf(ErrInvalidCharRange, pos, pos+len(`\p`))
+	}
+	sign := rest[1:2]
+	p.pos += 2
+	if !p.hasMore() {
+		return node{}, false, p.errorf(ErrInvalidCharRange, pos, p.pos)
+	}
+
+	name := ""
+	if p.peek() == '{' {
+		end := strings.IndexByte(p.pattern[p.pos:], '}')
+		if end < 0 {
+			return node{}, false, p.errorf(ErrInvalidCharRange, pos, len(p.pattern))
+		}
+		name = p.pattern[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+	} else {
+		name = string(p.next())
+	}
+	if strings.HasPrefix(name, "^") {
+		name = name[1:]
+		if sign == "p" {
+			sign = "P"
+		} else {
+			sign = "p"
+		}
+	}
+	if _, ok := propertyRanges(name); !ok {
+		return node{}, false, p.errorf(ErrInvalidCharRange, pos, p.pos)
+	}
+	return node{"Property", []node{{sign, []node{}, pos}, {name, []node{}, pos}}, pos}, true, nil
+}
+
+func isValidCaptureName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if ch != '_' && !unicode.IsLetter(ch) && !unicode.IsDigit(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// dot desugars . into the class [^\n], or into every rune, or byte, under
+// DotNL.
+func (p *parser) dot() node {
+	pos := p.pos
+	p.next()
+	if p.flags&DotNL != 0 {
+		all := universe(p.flags)
+		return node{"Class", []node{rangeNode(all.Lo, all.Hi, pos)}, pos}
+	}
+	return node{"Class", []node{newNode('^', pos), rangeNode('\n', '\n', pos)}, pos}
+}
+
+// class parses a bracket expression such as [a-z_] or [^\]\-]. A ']' right
+// after the opening bracket (or its '^') is a literal member, as is a '-' that
+// cannot start a range.
+func (p *parser) class() (node, error) {
+	pos := p.pos
+	p.next()
+
+	children := p.classFlags()
+	if p.hasMore() && p.peek() == '^' {
+		children = append(children, newNode(p.next(), p.pos-len("^")))
+	}
+
+	start := p.pos
+	for {
+		if !p.hasMore() {
+			return node{}, p.errorf(ErrMissingBracket, pos, pos+1)
+		}
+		if p.peek() == ']' && p.pos > start {
+			p.next()
+			return node{"Class", children, pos}, nil
+		}
+
+		loPos := p.pos
+		lo, err := p.classChar()
+		if err != nil {
+			return node{}, err
+		}
+		if lo.lable == "Perl" || lo.lable == "Property" {
+			children = append(children, lo)
+			continue
+		}
+
+		hi := lo
+		if p.pos+1 < len(p.pattern) && p.peek() == '-' && p.pattern[p.pos+1] != ']' {
+			p.next()
+			hi, err = p.classChar()
+			if err != nil {
+				return node{}, err
+			}
+			if hi.lable == "Perl" || hi.lable == "Property" || hi.lable < lo.lable {
+				return node{}, p.errorf(ErrInvalidCharRange, loPos, p.pos)
+			}
+		}
+		children = append(children, node{"Range", []node{lo, hi}, loPos})
+	}
+}
+
+func (p *parser) classChar() (node, error) {
+	pos := p.pos
+	if property, ok, err := p.property(); ok || err != nil {
+		return property, err
+	}
+	if p.peek() == '\\' {
+		p.next()
+		if !p.hasMore() {
+			return node{}, p.errorf(ErrTrailingBackslash, pos, pos+1)
+		}
+		ch, value, err := p.escape(pos)
+		if err != nil {
+			return node{}, err
+		}
+		if !value && isPerlClass(ch.lable) {
+			return node{"Perl", []node{ch}, pos}, nil
+		}
+		return ch, nil
+	}
+	if p.flags&Bytes != 0 && p.peek() >= utf8.RuneSelf {
+		p.next()
+		return node{}, p.errorf(ErrInvalidCharRange, pos, p.pos)
+	}
+	return newNode(p.next(), pos), nil
 }
 
-func isMetaChar(ch byte) bool {
+func isMetaChar(ch rune) bool {
 	return ch == '*' || ch == '+' || ch == '?'
 }
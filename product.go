@@ -0,0 +1,217 @@
+package automata
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Intersect returns a DFA that accepts the strings that both a and b accept.
+func Intersect(a, b *DFA) *DFA {
+	return product(a, b, func(inA, inB bool) bool { return inA && inB })
+}
+
+// Union returns a DFA that accepts the strings that a or b accepts.
+func Union(a, b *DFA) *DFA {
+	return product(a, b, func(inA, inB bool) bool { return inA || inB })
+}
+
+// Difference returns a DFA that accepts the strings that a accepts and b
+// does not.
+func Difference(a, b *DFA) *DFA {
+	return product(a, b, func(inA, inB bool) bool { return inA && !inB })
+}
+
+// SymmetricDifference returns a DFA that accepts the strings that exactly one
+// of a and b accepts. It accepts nothing iff a and b accept the same strings.
+func SymmetricDifference(a, b *DFA) *DFA {
+	return product(a, b, func(inA, inB bool) bool { return inA != inB })
+}
+
+// productState pairs a state of each DFA, with "" for the dead state that
+// the tables leave out.
+type productState struct {
+	a, b string
+}
+
+func (s productState) dead() bool {
+	return s.a == "" && s.b == ""
+}
+
+// product runs a and b side by side over an alphabet that refines both of
+// theirs, and accepts where accept says so for the pair of states reached.
+// Like the tables it reads, the result leaves out the states that can no
+// longer accept.
+func product(a, b *DFA, accept func(inA, inB bool) bool) *DFA {
+	if a.bytes != b.bytes {
+		panic("automata: product of a byte mode and a UTF-8 DFA")
+	}
+	tableA, tableB := a.GetTransitionTable(), b.GetTransitionTable()
+	alphabetA, alphabetB := a.GetAlphabet(), b.GetAlphabet()
+	acceptingA, acceptingB := a.GetAcceptingStateNums(), b.GetAcceptingStateNums()
+
+	// every symbol of the common alphabet lies within a single symbol of
+	// each DFA, or outside all of them
+	alphabet := partitionRanges(append(append([]RuneRange{}, alphabetA...), alphabetB...))
+	step := func(table map[string]map[RuneRange]string, symbols []RuneRange, label string, symbol RuneRange) string {
+		k, ok := findRange(symbols, symbol.Lo)
+		if label == "" || !ok {
+			return ""
+		}
+		return table[label][symbols[k]]
+	}
+
+	start := productState{a.startState, b.startState}
+	accepting := make(map[productState]bool)
+	transitions := make(map[productState]map[RuneRange]productState)
+	predecessors := make(map[productState][]productState)
+	for queue := []productState{start}; len(queue) > 0; queue = queue[1:] {
+		st := queue[0]
+		if transitions[st] != nil {
+			continue
+		}
+		transitions[st] = make(map[RuneRange]productState)
+		if accept(acceptingA[st.a], acceptingB[st.b]) {
+			accepting[st] = true
+		}
+		for _, symbol := range alphabet {
+			next := productState{step(tableA, alphabetA, st.a, symbol), step(tableB, alphabetB, st.b, symbol)}
+			if next.dead() {
+				continue
+			}
+			transitions[st][symbol] = next
+			predecessors[next] = append(predecessors[next], st)
+			if transitions[next] == nil {
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	// keep the states that can still reach an accepting one
+	live := make(map[productState]bool)
+	for queue := slices.Collect(maps.Keys(accepting)); len(queue) > 0; queue = queue[1:] {
+		if live[queue[0]] {
+			continue
+		}
+		live[queue[0]] = true
+		queue = append(queue, predecessors[queue[0]]...)
+	}
+
+	// number the states breadth-first from the start state, following the
+	// sorted alphabet, as remapStateNumbers does
+	result := DFA{
+		alphabet:           alphabet,
+		startState:         "1",
+		acceptingStateNums: make(map[string]bool),
+		transTable:         make(map[string]map[RuneRange]string),
+		matchOnly:          a.hasAssertions() || b.hasAssertions(),
+		bytes:              a.bytes,
+	}
+	numbers := map[productState]string{start: "1"}
+	for queue := []productState{start}; len(queue) > 0; queue = queue[1:] {
+		st := queue[0]
+		row := make(map[RuneRange]string)
+		for _, symbol := range alphabet {
+			next, ok := transitions[st][symbol]
+			if !ok || !live[next] {
+				continue
+			}
+			if _, ok := numbers[next]; !ok {
+				numbers[next] = strconv.Itoa(len(numbers) + 1)
+				queue = append(queue, next)
+			}
+			row[symbol] = numbers[next]
+		}
+		result.transTable[numbers[st]] = row
+		if accepting[st] {
+			result.acceptingStateNums[numbers[st]] = true
+		}
+	}
+	return &result
+}
+
+// Complete returns a DFA with a transition on every symbol from every state,
+// adding a sink state that never accepts for the ones that were missing. The
+// symbols are those of alphabet, together with the ones dfa already has
+// transitions on, so that it accepts the same strings.
+func (dfa *DFA) Complete(alphabet []RuneRange) *DFA {
+	table := dfa.GetTransitionTable()
+	own := dfa.GetAlphabet()
+	symbols := partitionRanges(append(append([]RuneRange{}, own...), alphabet...))
+
+	completed := DFA{
+		alphabet:           symbols,
+		startState:         dfa.startState,
+		acceptingStateNums: maps.Clone(dfa.GetAcceptingStateNums()),
+		matchedStateNums:   maps.Clone(dfa.matchedStateNums),
+		startStates:        maps.Clone(dfa.startStates),
+		transTable:         make(map[string]map[RuneRange]string),
+		matchOnly:          dfa.matchOnly,
+		bytes:              dfa.bytes,
+	}
+	sink := strconv.Itoa(len(table) + 1)
+	needSink := false
+	for label, row := range table {
+		completed.transTable[label] = make(map[RuneRange]string)
+		for _, symbol := range symbols {
+			next := sink
+			if k, ok := findRange(own, symbol.Lo); ok {
+				if to, ok := row[own[k]]; ok {
+					next = to
+				}
+			}
+			needSink = needSink || next == sink
+			completed.transTable[label][symbol] = next
+		}
+	}
+	if needSink {
+		completed.transTable[sink] = make(map[RuneRange]string)
+		for _, symbol := range symbols {
+			completed.transTable[sink][symbol] = sink
+		}
+	}
+	return &completed
+}
+
+// Complement returns a DFA that accepts the strings dfa does not, over all
+// runes, or all bytes in byte mode.
+func (dfa *DFA) Complement() *DFA {
+	all := AnyRune
+	if dfa.bytes {
+		all = AnyByte
+	}
+	complement := dfa.Complete([]RuneRange{all})
+	complement.matchOnly = complement.hasAssertions()
+	complement.matchedStateNums = nil
+	complement.startStates = nil
+
+	accepting := complement.acceptingStateNums
+	complement.acceptingStateNums = make(map[string]bool)
+	for label := range complement.transTable {
+		if !accepting[label] {
+			complement.acceptingStateNums[label] = true
+		}
+	}
+	return complement
+}
+
+// fragment turns the DFA back into an NFA fragment, whose accepting states
+// lead to a fresh out state.
+func (dfa *DFA) fragment() NFA {
+	table := dfa.GetTransitionTable()
+	accepting := dfa.GetAcceptingStateNums()
+	states := make(map[string]*state, len(table))
+	for label := range table {
+		states[label] = State(false)
+	}
+	outstate := State(true)
+	for label, row := range table {
+		for symbol, next := range row {
+			states[label].addTransition(symbol, states[next])
+		}
+		if accepting[label] {
+			states[label].addTransition(EpsilonRange, outstate)
+		}
+	}
+	return NFA{in: states[dfa.startState], out: outstate, bytes: dfa.bytes}
+}
@@ -0,0 +1,204 @@
+package automata
+
+import (
+	"slices"
+	"strconv"
+	"unicode"
+)
+
+// RuneRange labels a transition taken on any rune in [Lo, Hi].
+type RuneRange struct {
+	Lo, Hi rune
+}
+
+var (
+	EpsilonRange        = RuneRange{-1, -1}
+	EpsilonClosureRange = RuneRange{-2, -2}
+	AnyRune             = RuneRange{0, unicode.MaxRune}
+	AnyByte             = RuneRange{0, 0xff}
+)
+
+// universe returns the symbols a pattern compiled with flags ranges over.
+func universe(flags Flags) RuneRange {
+	if flags&Bytes != 0 {
+		return AnyByte
+	}
+	return AnyRune
+}
+
+func (r RuneRange) contains(ch rune) bool {
+	return r.Lo <= ch && ch <= r.Hi
+}
+
+func (r RuneRange) isSymbol() bool {
+	return r.Lo >= 0
+}
+
+func (r RuneRange) String() string {
+	switch r {
+	case EpsilonRange:
+		return EPSILON
+	case EpsilonClosureRange:
+		return EPSILON_CLOSURE
+	}
+	if r.Lo == r.Hi {
+		return runeString(r.Lo)
+	}
+	return "[" + runeString(r.Lo) + "-" + runeString(r.Hi) + "]"
+}
+
+func runeString(ch rune) string {
+	if unicode.IsPrint(ch) {
+		return string(ch)
+	}
+	quoted := strconv.QuoteRuneToASCII(ch)
+	return quoted[1 : len(quoted)-1]
+}
+
+func compareRanges(a, b RuneRange) int {
+	if a.Lo != b.Lo {
+		return int(a.Lo - b.Lo)
+	}
+	return int(a.Hi - b.Hi)
+}
+
+// normalizeRanges sorts ranges and merges the ones that overlap or touch.
+func normalizeRanges(ranges []RuneRange) []RuneRange {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, compareRanges)
+
+	merged := []RuneRange{}
+	for _, r := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && r.Lo <= merged[last].Hi+1 {
+			merged[last].Hi = max(merged[last].Hi, r.Hi)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// negateRanges complements ranges within universe.
+func negateRanges(ranges []RuneRange, universe RuneRange) []RuneRange {
+	negated := []RuneRange{}
+	next := universe.Lo
+	for _, r := range normalizeRanges(ranges) {
+		if r.Hi < universe.Lo || r.Lo > universe.Hi {
+			continue
+		}
+		if r.Lo > next {
+			negated = append(negated, RuneRange{next, r.Lo - 1})
+		}
+		next = max(next, r.Hi+1)
+	}
+	if next <= universe.Hi {
+		negated = append(negated, RuneRange{next, universe.Hi})
+	}
+	return negated
+}
+
+// partitionRanges splits possibly overlapping ranges into sorted, disjoint
+// equivalence classes: two runes share a class iff every input range contains
+// both or neither of them. Runes outside every range belong to no class.
+func partitionRanges(ranges []RuneRange) []RuneRange {
+	deltas := make(map[rune]int)
+	for _, r := range ranges {
+		deltas[r.Lo]++
+		deltas[r.Hi+1]--
+	}
+
+	cuts := make([]rune, 0, len(deltas))
+	for cut := range deltas {
+		cuts = append(cuts, cut)
+	}
+	slices.Sort(cuts)
+
+	classes := []RuneRange{}
+	depth := 0
+	for i := 0; i+1 < len(cuts); i++ {
+		depth += deltas[cuts[i]]
+		if depth > 0 {
+			classes = append(classes, RuneRange{cuts[i], cuts[i+1] - 1})
+		}
+	}
+	return classes
+}
+
+// findRange returns the index of the range in sorted, disjoint ranges that
+// contains ch.
+func findRange(ranges []RuneRange, ch rune) (int, bool) {
+	i, found := slices.BinarySearchFunc(ranges, ch, func(r RuneRange, ch rune) int {
+		if r.Hi < ch {
+			return -1
+		}
+		if r.Lo > ch {
+			return 1
+		}
+		return 0
+	})
+	return i, found
+}
+
+// minFold and maxFold bound the runes that have case folds other than
+// themselves.
+const (
+	minFold = 0x0041
+	maxFold = 0x1e943
+)
+
+// foldRanges adds the simple case folds of every rune in ranges that are no
+// greater than limit, so that the result matches regardless of case.
+func foldRanges(ranges []RuneRange, limit rune) []RuneRange {
+	folded := slices.Clone(ranges)
+	for _, r := range ranges {
+		for ch := max(r.Lo, minFold); ch <= min(r.Hi, maxFold, limit); ch++ {
+			for fold := unicode.SimpleFold(ch); fold != ch; fold = unicode.SimpleFold(fold) {
+				if fold <= limit {
+					folded = append(folded, RuneRange{fold, fold})
+				}
+			}
+		}
+	}
+	return normalizeRanges(folded)
+}
+
+// propertyRanges returns the ranges of a Unicode general category such as Lu
+// or L, of a script such as Greek, or of Any.
+func propertyRanges(name string) ([]RuneRange, bool) {
+	if name == "Any" {
+		return []RuneRange{AnyRune}, true
+	}
+	if table, ok := unicode.Categories[name]; ok {
+		return tableRanges(table), true
+	}
+	if table, ok := unicode.Scripts[name]; ok {
+		return tableRanges(table), true
+	}
+	return nil, false
+}
+
+// tableRanges converts Unicode range tables into sorted, disjoint ranges,
+// splitting the strided entries into single runes.
+func tableRanges(tables ...*unicode.RangeTable) []RuneRange {
+	ranges := []RuneRange{}
+	for _, table := range tables {
+		for _, r := range table.R16 {
+			ranges = appendStrided(ranges, rune(r.Lo), rune(r.Hi), rune(r.Stride))
+		}
+		for _, r := range table.R32 {
+			ranges = appendStrided(ranges, rune(r.Lo), rune(r.Hi), rune(r.Stride))
+		}
+	}
+	return normalizeRanges(ranges)
+}
+
+func appendStrided(ranges []RuneRange, lo, hi, stride rune) []RuneRange {
+	if stride == 1 {
+		return append(ranges, RuneRange{lo, hi})
+	}
+	for ch := lo; ch <= hi; ch += stride {
+		ranges = append(ranges, RuneRange{ch, ch})
+	}
+	return ranges
+}
@@ -0,0 +1,515 @@
+package automata
+
+import (
+	"slices"
+	"sync"
+	"unicode/utf8"
+)
+
+type input interface {
+	string | []byte
+}
+
+// decodeRune decodes the rune at i, reading a byte of invalid UTF-8 as a
+// U+FFFD of width 1. In byte mode every byte stands for itself.
+func decodeRune[T input](s T, i int, bytes bool) (rune, int) {
+	if ch := s[i]; ch < utf8.RuneSelf || bytes {
+		return rune(ch), 1
+	}
+	return utf8.DecodeRuneInString(string(s[i:min(i+utf8.UTFMax, len(s))]))
+}
+
+// decodeLastRune decodes the rune that ends at i, or returns -1 at the start.
+func decodeLastRune[T input](s T, i int, bytes bool) rune {
+	if i == 0 {
+		return -1
+	}
+	if bytes {
+		return rune(s[i-1])
+	}
+	ch, _ := utf8.DecodeLastRuneInString(string(s[max(i-utf8.UTFMax, 0):i]))
+	return ch
+}
+
+type progEdge struct {
+	symbol RuneRange
+	next   []int
+}
+
+// prog is an indexed copy of the NFA graph. The ε-edges of a state keep the
+// order they were added in, which is the priority order used by
+// leftmost-first matching: the left side of a choice before the right one,
+// another loop iteration before leaving the loop. asserts collects the
+// assertions of all states; the precomputed closures ignore them.
+type prog struct {
+	start   int
+	accept  []bool
+	slot    []int
+	assert  []EmptyOp
+	asserts EmptyOp
+	epsilon [][]int
+	closure [][]int
+	edges   [][]progEdge
+	numCap  int
+	bytes   bool
+}
+
+// progCache holds the prog of an NFA. The copies of the NFA share it, and
+// once lets goroutines that search with the same NFA build it only once.
+type progCache struct {
+	once sync.Once
+	prog *prog
+}
+
+func (nfa NFA) getProg() *prog {
+	if nfa.compiled == nil {
+		return nfa.buildProg()
+	}
+	nfa.compiled.once.Do(func() { nfa.compiled.prog = nfa.buildProg() })
+	return nfa.compiled.prog
+}
+
+func (nfa NFA) buildProg() *prog {
+	states := nfa.states()
+	index := make(map[*state]int, len(states))
+	for i, st := range states {
+		index[st] = i
+	}
+
+	p := prog{
+		start:   index[nfa.in],
+		accept:  make([]bool, len(states)),
+		slot:    make([]int, len(states)),
+		assert:  make([]EmptyOp, len(states)),
+		epsilon: make([][]int, len(states)),
+		closure: make([][]int, len(states)),
+		edges:   make([][]progEdge, len(states)),
+		bytes:   nfa.bytes,
+	}
+	for i, st := range states {
+		p.accept[i] = st.IsAccepted
+		p.slot[i] = st.Slot
+		p.assert[i] = st.Assert
+		p.asserts |= st.Assert
+		p.numCap = max(p.numCap, st.Slot/2)
+		for _, nextState := range st.getTransition(EpsilonRange) {
+			p.epsilon[i] = append(p.epsilon[i], index[nextState])
+		}
+		for closureState := range st.epsilonClosure() {
+			p.closure[i] = append(p.closure[i], index[closureState])
+		}
+
+		symbols := []RuneRange{}
+		for symbol := range st.Transitions {
+			if symbol.isSymbol() {
+				symbols = append(symbols, symbol)
+			}
+		}
+		slices.SortFunc(symbols, compareRanges)
+		for _, symbol := range symbols {
+			edge := progEdge{symbol: symbol}
+			for _, nextState := range st.getTransition(symbol) {
+				edge.next = append(edge.next, index[nextState])
+			}
+			p.edges[i] = append(p.edges[i], edge)
+		}
+	}
+	return &p
+}
+
+// thread is a position in the prog together with the submatch slots recorded
+// on the way there; caps[0] is where its match started. A thread with accept
+// set stands for the match that ends at its state.
+type thread struct {
+	pc     int
+	caps   []int
+	accept bool
+}
+
+type threadList struct {
+	threads []thread
+	mark    []int
+	gen     int
+}
+
+func newThreadList(size int) *threadList {
+	return &threadList{mark: make([]int, size), gen: 1}
+}
+
+func (l *threadList) clear() {
+	l.threads = l.threads[:0]
+	l.gen++
+}
+
+// addThread follows ε-edges from pc in priority order, recording pos in the
+// slots it passes and skipping the states whose assertions do not hold in
+// context. Consuming from a state ranks before anything reachable
+// over its ε-edges, and accepting at a state ranks after it, which makes the
+// repetition operators greedy. The caps slice is shared until a slot is
+// written.
+func (p *prog) addThread(list *threadList, pc int, caps []int, pos int, context EmptyOp) {
+	if list.mark[pc] == list.gen {
+		return
+	}
+	list.mark[pc] = list.gen
+	if p.assert[pc]&^context != 0 {
+		return
+	}
+
+	if slot := p.slot[pc]; slot >= 0 && slot < len(caps) {
+		caps = slices.Clone(caps)
+		caps[slot] = pos
+	}
+
+	if len(p.edges[pc]) > 0 {
+		list.threads = append(list.threads, thread{pc: pc, caps: caps})
+	}
+	for _, next := range p.epsilon[pc] {
+		p.addThread(list, next, caps, pos, context)
+	}
+	if p.accept[pc] {
+		list.threads = append(list.threads, thread{pc: pc, caps: caps, accept: true})
+	}
+}
+
+// step advances every thread in clist over the rune ch at pos into nlist,
+// recording matches that end at pos. context holds at the position after ch.
+// Under leftmost-first semantics a match cuts off all lower priority threads;
+// under leftmost-longest only the threads that started after the match are
+// dropped.
+func (p *prog) step(clist, nlist *threadList, ch rune, pos, width int, context EmptyOp, longest bool, match *[]int) {
+	for _, t := range clist.threads {
+		if *match != nil && longest && t.caps[0] > (*match)[0] {
+			continue
+		}
+		if t.accept {
+			if !longest || *match == nil || t.caps[0] < (*match)[0] || pos > (*match)[1] {
+				*match = slices.Clone(t.caps)
+				(*match)[1] = pos
+			}
+			if !longest {
+				break
+			}
+			continue
+		}
+		for _, edge := range p.edges[t.pc] {
+			if edge.symbol.contains(ch) {
+				for _, next := range edge.next {
+					p.addThread(nlist, next, t.caps, pos+width, context)
+				}
+			}
+		}
+	}
+}
+
+// nfaFind runs the Pike VM: every thread of the NFA advances in lockstep over
+// the input, so the search takes time linear in len(s) for a given NFA. It
+// returns the slots of the leftmost match in s that starts at or after pos,
+// ncap of them, with -1 for the groups that did not participate.
+func nfaFind[T input](nfa *NFA, s T, pos int, ncap int) []int {
+	p := nfa.getProg()
+	clist, nlist := newThreadList(len(p.accept)), newThreadList(len(p.accept))
+
+	var match []int
+	prev := decodeLastRune(s, pos, p.bytes)
+	for i := pos; ; {
+		ch, width := rune(-1), 0
+		if i < len(s) {
+			ch, width = decodeRune(s, i, p.bytes)
+		}
+
+		if match == nil {
+			caps := make([]int, ncap)
+			for k := range caps {
+				caps[k] = -1
+			}
+			caps[0] = i
+			p.addThread(clist, p.start, caps, i, emptyOpContext(prev, ch))
+		} else if len(clist.threads) == 0 {
+			break
+		}
+
+		after := rune(-1)
+		if i+width < len(s) {
+			after, _ = decodeRune(s, i+width, p.bytes)
+		}
+		p.step(clist, nlist, ch, i, width, emptyOpContext(ch, after), nfa.longest, &match)
+		if i == len(s) {
+			break
+		}
+
+		clist, nlist = nlist, clist
+		nlist.clear()
+		prev = ch
+		i += width
+	}
+	return match
+}
+
+// dfaFind returns the leftmost-longest match in s that starts at or after pos.
+// It makes one pass over s, starting the DFA afresh at every position until a
+// match turns up and keeping for each state only the leftmost start that
+// reached it: two starts in the same state have the same matches ahead of
+// them, so the later one can never win. The work per rune is bounded by the
+// number of states.
+//
+// With assertions a DFA only learns that a match ended before a rune after
+// reading it, so matches inside s come from the matched states instead.
+func dfaFind[T input](dfa *DFA, s T, pos int) []int {
+	table := dfa.GetTransitionTable()
+	// the products, complements and Brzozowski minimizations of DFAs with
+	// assertions keep only what Matches needs, which is not enough to find
+	// where a match starts or ends
+	if dfa.matchOnly {
+		panic("automata: search on a DFA built from one with assertions")
+	}
+	alphabet := dfa.GetAlphabet()
+	acceptingStateNums := dfa.GetAcceptingStateNums()
+	delayed := dfa.matchedStateNums != nil
+
+	var match []int
+	record := func(start, end int) {
+		if match == nil || start < match[0] || start == match[0] && end > match[1] {
+			match = []int{start, end}
+		}
+	}
+
+	threads, next := make(map[string]int), make(map[string]int)
+	prev := decodeLastRune(s, pos, dfa.bytes)
+	for i := pos; ; {
+		if match == nil {
+			if state, ok := dfa.startAt(prev); ok {
+				if _, ok := threads[state]; !ok {
+					threads[state] = i
+				}
+			}
+		} else if len(threads) == 0 {
+			break
+		}
+
+		for state, start := range threads {
+			if acceptingStateNums[state] && (!delayed || i == len(s)) {
+				record(start, i)
+			}
+		}
+		if i == len(s) {
+			break
+		}
+
+		ch, width := decodeRune(s, i, dfa.bytes)
+		clear(next)
+		if k, found := findRange(alphabet, ch); found {
+			for state, start := range threads {
+				if match != nil && start > match[0] {
+					continue
+				}
+				nextState, ok := table[state][alphabet[k]]
+				if !ok {
+					continue
+				}
+				if delayed && dfa.matchedStateNums[nextState] {
+					record(start, i)
+				}
+				if earlier, ok := next[nextState]; !ok || start < earlier {
+					next[nextState] = start
+				}
+			}
+		}
+		threads, next = next, threads
+		prev = ch
+		i += width
+	}
+	return match
+}
+
+// findAll collects successive non-overlapping matches, at most n of them if
+// n >= 0. An empty match right after the previous match is skipped.
+func findAll[T input](s T, n int, bytes bool, find func(T, int) []int) [][]int {
+	var matches [][]int
+	prevEnd := -1
+	for pos := 0; (n < 0 || len(matches) < n) && pos <= len(s); {
+		match := find(s, pos)
+		if match == nil {
+			break
+		}
+
+		accept := true
+		if match[1] == pos {
+			if match[0] == prevEnd {
+				accept = false
+			}
+			if pos < len(s) {
+				_, width := decodeRune(s, pos, bytes)
+				pos += width
+			} else {
+				pos++
+			}
+		} else {
+			pos = match[1]
+		}
+		prevEnd = match[1]
+
+		if accept {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+func substrings(s string, locs [][]int) []string {
+	if locs == nil {
+		return nil
+	}
+	strs := make([]string, len(locs))
+	for i, loc := range locs {
+		strs[i] = s[loc[0]:loc[1]]
+	}
+	return strs
+}
+
+// Longest makes future searches leftmost-longest: among the matches that
+// start leftmost, the longest one wins. The default is leftmost-first, which
+// prefers the match found by the earlier alternative and the greedier loop.
+func (nfa *NFA) Longest() {
+	nfa.longest = true
+}
+
+// MatchBytes is Matches on b.
+func (nfa NFA) MatchBytes(b []byte) bool {
+	p := nfa.getProg()
+	return simulate(p, []int{p.start}, -1, b)
+}
+
+func (nfa *NFA) FindIndex(b []byte) []int {
+	return nfaFind(nfa, b, 0, 2)
+}
+
+func (nfa *NFA) FindStringIndex(s string) []int {
+	return nfaFind(nfa, s, 0, 2)
+}
+
+func (nfa *NFA) FindString(s string) string {
+	loc := nfa.FindStringIndex(s)
+	if loc == nil {
+		return ""
+	}
+	return s[loc[0]:loc[1]]
+}
+
+func (nfa *NFA) FindAllIndex(b []byte, n int) [][]int {
+	return findAll(b, n, nfa.bytes, func(b []byte, pos int) []int {
+		return nfaFind(nfa, b, pos, 2)
+	})
+}
+
+func (nfa *NFA) FindAllStringIndex(s string, n int) [][]int {
+	return findAll(s, n, nfa.bytes, func(s string, pos int) []int {
+		return nfaFind(nfa, s, pos, 2)
+	})
+}
+
+func (nfa *NFA) FindAllString(s string, n int) []string {
+	return substrings(s, nfa.FindAllStringIndex(s, n))
+}
+
+// NumSubexp returns the number of groups in the pattern, including the ones
+// that cannot take part in a match. An NFA built by hand has as many as its
+// slot states record.
+func (nfa *NFA) NumSubexp() int {
+	if nfa.names != nil {
+		return len(nfa.names) - 1
+	}
+	return nfa.getProg().numCap
+}
+
+func (nfa *NFA) SubexpNames() []string {
+	if nfa.names != nil {
+		return nfa.names
+	}
+	return make([]string, nfa.NumSubexp()+1)
+}
+
+// SubexpIndex returns the number of the group with the given name, or -1.
+func (nfa *NFA) SubexpIndex(name string) int {
+	if name != "" {
+		for i, groupName := range nfa.SubexpNames() {
+			if groupName == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// FindSubmatchIndex returns the leftmost match and its groups as pairs of
+// indexes: group i spans b[loc[2*i]:loc[2*i+1]], or is -1, -1 if it did not
+// participate in the match.
+func (nfa *NFA) FindSubmatchIndex(b []byte) []int {
+	return nfaFind(nfa, b, 0, 2*nfa.NumSubexp()+2)
+}
+
+func (nfa *NFA) FindStringSubmatchIndex(s string) []int {
+	return nfaFind(nfa, s, 0, 2*nfa.NumSubexp()+2)
+}
+
+func (nfa *NFA) FindStringSubmatch(s string) []string {
+	loc := nfa.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil
+	}
+	strs := make([]string, len(loc)/2)
+	for i := range strs {
+		if loc[2*i] >= 0 {
+			strs[i] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	return strs
+}
+
+func (nfa *NFA) FindAllStringSubmatchIndex(s string, n int) [][]int {
+	ncap := 2*nfa.NumSubexp() + 2
+	return findAll(s, n, nfa.bytes, func(s string, pos int) []int {
+		return nfaFind(nfa, s, pos, ncap)
+	})
+}
+
+// The DFA search methods always use leftmost-longest semantics.
+
+func (dfa *DFA) MatchBytes(b []byte) bool {
+	if dfa.lazy != nil {
+		return lazyMatches(dfa.lazy, b)
+	}
+	return dfaMatches(dfa, b)
+}
+
+func (dfa *DFA) FindIndex(b []byte) []int {
+	return dfaFind(dfa, b, 0)
+}
+
+func (dfa *DFA) FindStringIndex(s string) []int {
+	return dfaFind(dfa, s, 0)
+}
+
+func (dfa *DFA) FindString(s string) string {
+	loc := dfa.FindStringIndex(s)
+	if loc == nil {
+		return ""
+	}
+	return s[loc[0]:loc[1]]
+}
+
+func (dfa *DFA) FindAllIndex(b []byte, n int) [][]int {
+	return findAll(b, n, dfa.bytes, func(b []byte, pos int) []int {
+		return dfaFind(dfa, b, pos)
+	})
+}
+
+func (dfa *DFA) FindAllStringIndex(s string, n int) [][]int {
+	return findAll(s, n, dfa.bytes, func(s string, pos int) []int {
+		return dfaFind(dfa, s, pos)
+	})
+}
+
+func (dfa *DFA) FindAllString(s string, n int) []string {
+	return substrings(s, dfa.FindAllStringIndex(s, n))
+}